@@ -0,0 +1,181 @@
+package main
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ActionLimits limit how many operations a user may submit at once in a room, and how often.
+type ActionLimits struct {
+	// Most operations in a single submission, 0 is unlimited.
+	ActionsAllowed int
+
+	// Milliseconds a user must wait between submissions, 0 is unlimited.
+	ActionWaitTime int64
+}
+
+// parseActionLimits reads the action limits from a firestore room document.
+func parseActionLimits(doc bson.M) ActionLimits {
+	return ActionLimits{
+		ActionsAllowed: int(opInt(doc, "actionsAllowed")),
+		ActionWaitTime: opInt(doc, "actionWaitTime"),
+	}
+}
+
+// lastActions tracks when users last submitted operations, by room and user.
+var lastActions = NewActionTracker()
+
+// ActionPruneInterval is how often, in milliseconds, submissions whose wait time has passed are forgotten.
+// Forgotten submissions are loaded from the user directory again if needed.
+const ActionPruneInterval = 60 * 1000
+
+// actionRecord is when a user last submitted operations in a room, and the wait time it was limited by.
+type actionRecord struct {
+	at       int64
+	waitTime int64
+}
+
+// ActionTracker is a concurrency-safe record of when users last submitted operations in a room.
+type ActionTracker struct {
+	sync.Mutex
+	last map[string]actionRecord
+
+	// Time after which records whose wait time has passed are next pruned, in milliseconds.
+	nextPrune int64
+}
+
+// NewActionTracker instantiates an ActionTracker.
+func NewActionTracker() *ActionTracker {
+	return &ActionTracker{
+		last: make(map[string]actionRecord),
+	}
+}
+
+// actionKey returns the key a user's submissions in a room are tracked by.
+func actionKey(roomName string, userID string) string {
+	return roomName + "/" + userID
+}
+
+// Has returns whether submissions are tracked for a key.
+func (t *ActionTracker) Has(key string) bool {
+	t.Lock()
+	defer t.Unlock()
+	_, ok := t.last[key]
+	return ok
+}
+
+// Load records a submission made before the server tracked the key, keeping the latest.
+func (t *ActionTracker) Load(key string, last int64) {
+	t.Lock()
+	defer t.Unlock()
+	if record := t.last[key]; last > record.at {
+		t.last[key] = actionRecord{at: last, waitTime: record.waitTime}
+	}
+}
+
+// Reserve records a submission at now if waitTime has passed since the last one. Returns the previous submission
+// time, and how many milliseconds remain until the next submission is allowed, 0 if it was recorded.
+func (t *ActionTracker) Reserve(key string, now int64, waitTime int64) (int64, int64) {
+	t.Lock()
+	defer t.Unlock()
+	t.prune(now)
+	previous := t.last[key].at
+	if elapsed := now - previous; elapsed < waitTime {
+		t.last[key] = actionRecord{at: previous, waitTime: waitTime}
+		return previous, waitTime - elapsed
+	}
+	t.last[key] = actionRecord{at: now, waitTime: waitTime}
+	return previous, 0
+}
+
+// Release undoes a submission recorded at now, unless another has been recorded since.
+func (t *ActionTracker) Release(key string, now int64, previous int64) {
+	t.Lock()
+	defer t.Unlock()
+	if record, ok := t.last[key]; ok && record.at == now {
+		t.last[key] = actionRecord{at: previous, waitTime: record.waitTime}
+	}
+}
+
+// prune forgets the submissions whose wait time has passed at now, at most every ActionPruneInterval.
+// The tracker must be locked.
+func (t *ActionTracker) prune(now int64) {
+	if now < t.nextPrune {
+		return
+	}
+	for key, record := range t.last {
+		if now-record.at >= record.waitTime {
+			delete(t.last, key)
+		}
+	}
+	t.nextPrune = now + ActionPruneInterval
+}
+
+// actionReservation is a submission recorded against a user's action limits before its operations are committed.
+type actionReservation struct {
+	roomName string
+	userID   string
+	at       int64
+	previous int64
+}
+
+// reserveActions checks a submission of n operations against the action limits of the client's room, recording it
+// as the user's last submission. Returns the error to send the client if the submission isn't allowed, otherwise
+// the reservation to commit or release, nil if there is no wait time to track.
+func reserveActions(c *Client, n int) (*actionReservation, *ErrorInfo) {
+	limits := c.Room.Metadata().Limits
+	if limits.ActionsAllowed > 0 && n > limits.ActionsAllowed {
+		return nil, NewError(ErrCodeTooManyActions, TypeOperations, "submitted %d operations, room %s allows %d at once", n, c.Room.RoomName, limits.ActionsAllowed)
+	}
+	if limits.ActionWaitTime <= 0 || n == 0 {
+		return nil, nil
+	}
+
+	// Start from the last submission in the user directory, which survives reconnects and restarts
+	key := actionKey(c.Room.RoomName, c.UserID)
+	if !lastActions.Has(key) && userDirectory != nil && c.UserID != "" {
+		last, err := userDirectory.GetLastOperation(c.UserID, c.Room.RoomName)
+		if err != nil {
+			log.Errorf("%s", err)
+		}
+		lastActions.Load(key, last)
+	}
+
+	now := nowMillis()
+	previous, wait := lastActions.Reserve(key, now, limits.ActionWaitTime)
+	if wait > 0 {
+		errInfo := NewError(ErrCodeRateLimited, TypeOperations, "room %s allows a submission every %dms, wait %dms", c.Room.RoomName, limits.ActionWaitTime, wait)
+		errInfo.RetryAfter = wait
+		return nil, errInfo
+	}
+	return &actionReservation{
+		roomName: c.Room.RoomName,
+		userID:   c.UserID,
+		at:       now,
+		previous: previous,
+	}, nil
+}
+
+// Commit persists the submission time to the user directory without blocking.
+func (r *actionReservation) Commit() {
+	if r == nil || userDirectory == nil || r.userID == "" {
+		return
+	}
+	directory := userDirectory
+	go func() {
+		err := directory.SetLastOperation(r.userID, r.roomName, r.at)
+		if err != nil {
+			log.Errorf("%s", err)
+		}
+	}()
+}
+
+// Release undoes the submission after its operations failed to commit.
+func (r *actionReservation) Release() {
+	if r == nil {
+		return
+	}
+	lastActions.Release(actionKey(r.roomName, r.userID), r.at, r.previous)
+}
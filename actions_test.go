@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestActionTrackerPrune(t *testing.T) {
+	tracker := NewActionTracker()
+	tracker.Reserve("room/alice", 1000, 500)
+	tracker.Reserve("room/bob", 1000, 5*ActionPruneInterval)
+	tracker.Load("room/carol", 900)
+
+	// Submissions within their wait time are kept through a prune
+	if _, wait := tracker.Reserve("room/alice", 1200, 500); wait != 300 {
+		t.Errorf("got wait %d, want 300", wait)
+	}
+	now := int64(1000 + ActionPruneInterval)
+	if _, wait := tracker.Reserve("room/dave", now, 500); wait != 0 {
+		t.Errorf("got wait %d for a first submission, want 0", wait)
+	}
+	for key, tracked := range map[string]bool{"room/alice": false, "room/bob": true, "room/carol": false, "room/dave": true} {
+		if tracker.Has(key) != tracked {
+			t.Errorf("got %s tracked %t, want %t", key, !tracked, tracked)
+		}
+	}
+
+	// Prunes are at most every ActionPruneInterval
+	if _, wait := tracker.Reserve("room/erin", now+1, 1); wait != 0 {
+		t.Errorf("got wait %d for a first submission, want 0", wait)
+	}
+	tracker.Reserve("room/dave", now+1000, 500)
+	if !tracker.Has("room/erin") {
+		t.Errorf("pruned again within the interval")
+	}
+	if len(tracker.last) != 3 {
+		t.Errorf("got %d tracked submissions, want 3", len(tracker.last))
+	}
+}
@@ -1,66 +1,117 @@
 package main
 
 import (
-	"encoding/json"
-
 	log "github.com/sirupsen/logrus"
-	"go.mongodb.org/mongo-driver/bson"
 )
 
 // Message types
 const (
-	TypeAnnounce   = "announce"   // [Client->Server] Provides a user ID to the client
+	TypeAnnounce   = "announce"   // [Client->Server] Provides a user ID to the client, and negotiates the protocol version
 	TypeEnterRoom  = "enterRoom"  // [Client->Server] Client associates with a room, and requests the current state
 	TypeExitRoom   = "exitRoom"   // [Client->Server] Client disassociates with a room
 	TypeOperations = "operations" // [Client->Server] Client makes submits operations
-	TypeState      = "state"      // [Client->Server] Client sends the full state to the server
+	TypeState      = "state"      // [Client->Server] Client sends the full state to the server, as of operation seq
+
+	TypeFetchOperations = "fetchOperations" // [Client->Server] Client requests the operations committed since a sequence number
+	TypeHistory         = "history"         // [Client->Server] Client requests the operations committed up to a sequence number or time
+	TypeTimeline        = "timeline"        // [Client->Server] Client requests a summary of when operations were committed
 
 	TypeOperationsUpdate = "operationsUpdate" // [Server->Client] Server disseminates operations to all Clients in a room
 	TypeRequestState     = "requestState"     // [Server->Client] Server asks a Client for the full state of the room
 	TypeClearState       = "clearState"       // [Server->Client] Server tells a Client to clear the current state
 	TypeNumMembersUpdate = "numMembersUpdate" // [Server->Client] Server tells a Client how many members are in the room
+	TypeError            = "error"            // [Server->Client] Server tells a Client a message failed
+	TypeOperationsChunk  = "operationsChunk"  // [Server->Client] Server sends more of the operations in a chunked response
 )
 
-// Message is the superset of the object websocket clients send.
-type Message struct {
-	ID            string   `json:"id"`
-	Type          string   `json:"type"`
-	UserID        string   `json:"userID"`
-	RoomName      string   `json:"roomName"`
-	OperationType string   `json:"operationType"`
-	Operations    []bson.M `json:"operations"`
-	State         bson.M   `json:"state"`
-	MessageTime   float64  `json:"messageTime"`
-}
-
-// dispatch fans out different types of messages from websocket clients.
-func dispatch(c *Client, b []byte) {
-	m := &Message{}
-	err := json.Unmarshal(b, m)
+// dispatch fans out different types of messages from websocket clients, decoded with codec.
+func dispatch(c *Client, codec Codec, b []byte) {
+	env := &Envelope{}
+	err := codec.Unmarshal(b, env)
 	if err != nil {
 		log.Errorf("unable to unmarshal message (%s): %s", b, err)
+		c.Send(NewErrorMessage("", NewError(ErrCodeBadMessage, "", "unable to unmarshal message: %s", err)))
+		return
 	}
 
-	switch m.Type {
+	// decode decodes the full message once its type is known
+	decode := func(m interface{}) bool {
+		err := codec.Unmarshal(b, m)
+		if err != nil {
+			log.Errorf("unable to unmarshal %s message (%s): %s", env.Type, b, err)
+			c.Send(NewErrorMessage(env.ID, NewError(ErrCodeBadMessage, env.Type, "unable to unmarshal %s message: %s", env.Type, err)))
+			return false
+		}
+		return true
+	}
+
+	// Clients too old to be served may only announce again
+	if c.upgradeRequired && env.Type != TypeAnnounce {
+		c.Send(NewErrorMessage(env.ID, NewError(ErrCodeUpgradeRequired, env.Type, "protocol version is no longer supported, minimum is %d", minProtocolVersion)))
+		return
+	}
+
+	// Clients must announce who they are before anything else
+	if c.UserID == "" && env.Type != TypeAnnounce {
+		c.Send(NewErrorMessage(env.ID, NewError(ErrCodeUnauthenticated, env.Type, "announce with an ID token first")))
+		return
+	}
+
+	switch env.Type {
 	case TypeAnnounce:
-		res := AnnounceHandler(c, m)
+		m := &AnnounceMessage{}
+		if !decode(m) {
+			break
+		}
+		res, replay := AnnounceHandler(c, m)
 		c.Send(res)
+		if replay != nil {
+			c.Send(replay)
+		}
 	case TypeEnterRoom:
-		res := EnterRoomHandler(c, m)
-		c.Send(res)
+		m := &EnterRoomMessage{}
+		if decode(m) {
+			sendEnterRoomResponse(c, EnterRoomHandler(c, m))
+		}
 	case TypeExitRoom:
-		res := ExitRoomHandler(c, m)
-		c.Send(res)
+		m := &ExitRoomMessage{}
+		if decode(m) {
+			c.Send(ExitRoomHandler(c, m))
+		}
 	case TypeOperations:
-		res, err := OperationsHandler(c, m)
-		if err != nil {
-			c.Send(err)
+		m := &OperationsMessage{}
+		if !decode(m) {
 			break
 		}
-		c.Room.Broadcast(res, c) // Ignore client committing operations
+		update, res := OperationsHandler(c, m)
+		if res != nil {
+			c.Send(res)
+		}
+		if update != nil {
+			c.Room.Broadcast(update, c) // Ignore client committing operations
+		}
+	case TypeFetchOperations:
+		m := &FetchOperationsMessage{}
+		if decode(m) {
+			c.Send(FetchOperationsHandler(c, m))
+		}
+	case TypeHistory:
+		m := &HistoryMessage{}
+		if decode(m) {
+			c.Send(HistoryHandler(c, m))
+		}
+	case TypeTimeline:
+		m := &TimelineMessage{}
+		if decode(m) {
+			c.Send(TimelineHandler(c, m))
+		}
 	case TypeState:
-		StateHandler(c, m)
+		m := &StateMessage{}
+		if decode(m) {
+			StateHandler(c, m)
+		}
 	default:
-		log.Warnf("message type \"%s\" not implemented", m.Type)
+		log.Warnf("message type \"%s\" not implemented", env.Type)
+		c.Send(NewErrorMessage(env.ID, NewError(ErrCodeUnknownType, env.Type, "message type \"%s\" not implemented", env.Type)))
 	}
 }
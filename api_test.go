@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestDispatch(t *testing.T) {
+	member := newTestRoom(t, "room", "alice", bson.M{})
+	c := newTestClient("bob")
+
+	dispatch(c, jsonCodec{}, []byte(`{"id":"1","type":"enterRoom","roomName":"room"}`))
+	res, ok := nextMessage(c).(*EnterRoomResponse)
+	if !ok || res.ID != "1" || res.Error != nil {
+		t.Fatalf("got response %+v, want to enter the room", res)
+	}
+	nextMessage(member) // numMembersUpdate
+
+	// Operations are broadcast to the other members only
+	dispatch(c, jsonCodec{}, []byte(`{"type":"operations","operations":[{"type":"ADD_STEP"}],"messageTime":3}`))
+	update, ok := nextMessage(member).(*OperationsUpdateMessage)
+	if !ok || update.Type != TypeOperationsUpdate || len(update.Operations) != 1 || update.MessageTime != 3 {
+		t.Fatalf("got update %+v, want the operation", update)
+	}
+	if queuedMessages(c) != 0 {
+		t.Errorf("the committing client was sent %d messages", queuedMessages(c))
+	}
+
+	// Operations with an ID are acknowledged with their seqs
+	dispatch(c, jsonCodec{}, []byte(`{"id":"ack","type":"operations","operations":[{"type":"ADD_STEP"},{"type":"ADD_STEP"}]}`))
+	ack, ok := nextMessage(c).(*OperationsResponse)
+	if !ok || ack.ID != "ack" || len(ack.Seqs) != 2 || ack.Seqs[0] != 2 || ack.Seqs[1] != 3 {
+		t.Errorf("got %+v, want an acknowledgement of seqs 2 and 3", ack)
+	}
+	nextMessage(member) // operationsUpdate
+
+	// Malformed and unknown messages get an error
+	tests := []struct {
+		message string
+		code    string
+	}{
+		{`{"id":"2","type":"operations","operations":"none"}`, ErrCodeBadMessage},
+		{`{"id":"3","type":"unknown"}`, ErrCodeUnknownType},
+		{`not json`, ErrCodeBadMessage},
+	}
+	for _, test := range tests {
+		dispatch(c, jsonCodec{}, []byte(test.message))
+		m, ok := nextMessage(c).(*ErrorMessage)
+		if !ok || m.Type != TypeError || m.Error.Code != test.code || m.Error.Retryable {
+			t.Errorf("got %+v for %s, want error %s", m, test.message, test.code)
+		}
+	}
+	if queuedMessages(member) != 0 {
+		t.Errorf("members were sent invalid messages")
+	}
+	if ops, _ := database.GetAllOperations("room"); len(ops) != 3 {
+		t.Errorf("got %d operations, want 3", len(ops))
+	}
+
+	b, err := jsonCodec{}.Marshal(NewOperationsUpdateMessage([]bson.M{{"type": "ADD_STEP"}}, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"type":"operationsUpdate","operations":[{"type":"ADD_STEP"}],"messageTime":3}` {
+		t.Errorf("got encoded update %s", b)
+	}
+}
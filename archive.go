@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Room archive format identifiers
+const (
+	ArchiveFormat  = "nime2020-room-archive"
+	ArchiveVersion = 1
+)
+
+// Kinds of lines in a room archive, which are written in this order
+const (
+	ArchiveKindHeader   = "header"   // Always the first line
+	ArchiveKindMetadata = "metadata" // Firestore room document, if available
+	ArchiveKindRoom     = "room"     // The RoomDoc
+	ArchiveKindBucket   = "bucket"   // One line per OpBucketDoc, in bucket order
+)
+
+// ArchiveHeader describes a room archive.
+type ArchiveHeader struct {
+	Format     string `bson:"format"`
+	Version    int    `bson:"version"`
+	RoomName   string `bson:"room_name"`
+	ExportedAt int64  `bson:"exported_at"`
+}
+
+// archiveLine is a single line of a room archive, encoded as relaxed extended JSON so BSON types survive.
+type archiveLine struct {
+	Kind     string         `bson:"kind"`
+	Header   *ArchiveHeader `bson:"header,omitempty"`
+	Metadata bson.M         `bson:"metadata,omitempty"`
+	Room     *RoomDoc       `bson:"room,omitempty"`
+	Bucket   *OpBucketDoc   `bson:"bucket,omitempty"`
+}
+
+// ExportRoom writes a room, its operation buckets (archived or not) and its firestore metadata as
+// JSON lines to w, gzipped if compress is set.
+func ExportRoom(w io.Writer, roomName string, compress bool) error {
+	if compress {
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		w = gz
+	}
+	writeLine := func(line *archiveLine) error {
+		b, err := bson.MarshalExtJSON(line, false, false)
+		if err != nil {
+			return fmt.Errorf("unable to encode archive %s: %w", line.Kind, err)
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+	}
+
+	room, err := database.GetRoom(roomName)
+	if err != nil {
+		return fmt.Errorf("unable to get room: %w", err)
+	}
+	err = writeLine(&archiveLine{
+		Kind: ArchiveKindHeader,
+		Header: &ArchiveHeader{
+			Format:     ArchiveFormat,
+			Version:    ArchiveVersion,
+			RoomName:   roomName,
+			ExportedAt: nowMillis(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if roomSource != nil {
+		metadata, err := roomSource.GetRoom(roomName)
+		if err != nil {
+			log.Warnf("exporting room %s without firestore metadata: %s", roomName, err)
+		} else {
+			err = writeLine(&archiveLine{Kind: ArchiveKindMetadata, Metadata: metadata})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = writeLine(&archiveLine{Kind: ArchiveKindRoom, Room: room})
+	if err != nil {
+		return err
+	}
+
+	var writeErr error
+	err = rangeOperationBuckets(roomName, func(bucketDoc OpBucketDoc, _ bool) bool {
+		writeErr = writeLine(&archiveLine{Kind: ArchiveKindBucket, Bucket: &bucketDoc})
+		return writeErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return writeErr
+}
+
+// ImportRoom reads a room archive (gzipped or not) from r and creates the room under roomName, or the archived
+// room name if roomName is empty. Firestore metadata is only written if withMetadata is set.
+func ImportRoom(r io.Reader, roomName string, withMetadata bool) (*RoomDoc, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read gzipped archive: %w", err)
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+
+	var header *ArchiveHeader
+	var metadata bson.M
+	var room *RoomDoc
+	buckets := []OpBucketDoc{}
+	for lineNum := 1; ; lineNum++ {
+		b, err := br.ReadBytes('\n')
+		if len(b) > 0 && !(len(b) == 1 && b[0] == '\n') {
+			line := &archiveLine{}
+			if unmarshalErr := bson.UnmarshalExtJSON(b, false, line); unmarshalErr != nil {
+				return nil, fmt.Errorf("unable to decode archive line %d: %w", lineNum, unmarshalErr)
+			}
+			if header == nil && line.Kind != ArchiveKindHeader {
+				return nil, fmt.Errorf("archive line %d: expected %s, got %s", lineNum, ArchiveKindHeader, line.Kind)
+			}
+			switch line.Kind {
+			case ArchiveKindHeader:
+				header = line.Header
+				if header == nil || header.Format != ArchiveFormat {
+					return nil, fmt.Errorf("not a %s", ArchiveFormat)
+				}
+				if header.Version > ArchiveVersion {
+					return nil, fmt.Errorf("archive version %d is newer than supported version %d", header.Version, ArchiveVersion)
+				}
+			case ArchiveKindMetadata:
+				metadata = line.Metadata
+			case ArchiveKindRoom:
+				room = line.Room
+			case ArchiveKindBucket:
+				if line.Bucket != nil {
+					buckets = append(buckets, *line.Bucket)
+				}
+			default:
+				log.Warnf("skipping unknown archive line %d of kind %s", lineNum, line.Kind)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read archive: %w", err)
+		}
+	}
+	if room == nil {
+		return nil, fmt.Errorf("archive does not contain a %s", ArchiveKindRoom)
+	}
+
+	// Rename and re-identify everything, so an archive can be imported alongside the original
+	if roomName == "" {
+		roomName = header.RoomName
+	}
+	room.ID = primitive.NewObjectID()
+	room.RoomName = roomName
+	room.NumMembers = 0
+	for i := range buckets {
+		buckets[i].ID = primitive.NewObjectID()
+		buckets[i].RoomName = roomName
+		if buckets[i].Bucket > room.NumBuckets {
+			room.NumBuckets = buckets[i].Bucket
+		}
+	}
+
+	err = database.ImportRoom(room, buckets)
+	if err != nil {
+		return nil, fmt.Errorf("unable to import room: %w", err)
+	}
+	log.Infof("imported room %s from %s (%d buckets)", roomName, header.RoomName, len(buckets))
+
+	if withMetadata && metadata != nil {
+		if roomSource == nil {
+			return nil, fmt.Errorf("imported room %s, but no metadata source is configured to import metadata", roomName)
+		}
+		err = roomSource.SetRoom(roomName, metadata)
+		if err != nil {
+			return nil, fmt.Errorf("imported room %s, but %w", roomName, err)
+		}
+	}
+	return room, nil
+}
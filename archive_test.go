@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestExportImportRoom(t *testing.T) {
+	newSnapshotTestStore("room", RoomTypePianoRollSequencer, 2)
+	for i := 0; i < 5; i++ {
+		commitTestOperations(t, "room", bson.M{"type": "ADD_STEP", "n": i})
+	}
+	_, err := SnapshotRoom("room", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compress := range []bool{false, true} {
+		var b bytes.Buffer
+		err := ExportRoom(&b, "room", compress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copyName := "copy"
+		if compress {
+			copyName = "gzipped copy"
+		}
+
+		// Archived buckets are exported along with the live ones
+		room, err := ImportRoom(&b, copyName, false)
+		if err != nil {
+			t.Fatalf("unable to import (compress: %t): %s", compress, err)
+		}
+		if room.RoomName != copyName || room.NumBuckets != 3 || room.LastSeq != 5 {
+			t.Errorf("got imported room %+v", room)
+		}
+		ops, _ := database.GetAllOperations(copyName)
+		if len(ops) != 5 {
+			t.Fatalf("got %d imported operations, want 5", len(ops))
+		}
+		for i, op := range ops {
+			if opSeq(op) != int64(i+1) || op["n"] != int32(i) && op["n"] != i {
+				t.Errorf("imported operation %d is %v", i, op)
+			}
+		}
+
+		// Committing continues the sequence
+		_, committed, err := database.CommitOperations(copyName, []bson.M{{"type": "ADD_STEP"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opSeq(committed[0]) != 6 {
+			t.Errorf("got seq %d after importing, want 6", opSeq(committed[0]))
+		}
+	}
+
+	// Rooms aren't overwritten
+	var b bytes.Buffer
+	ExportRoom(&b, "room", false)
+	if _, err = ImportRoom(&b, "copy", false); err == nil {
+		t.Errorf("imported over an existing room")
+	}
+}
+
+func TestImportRoomInvalid(t *testing.T) {
+	newSnapshotTestStore("room", "", 2)
+
+	tests := []struct {
+		name    string
+		archive string
+	}{
+		{"empty", ""},
+		{"not json", "not an archive\n"},
+		{"no header", `{"kind":"room","room":{"room_name":"room"}}` + "\n"},
+		{"other format", `{"kind":"header","header":{"format":"other","version":1}}` + "\n"},
+		{"newer version", `{"kind":"header","header":{"format":"` + ArchiveFormat + `","version":99}}` + "\n"},
+		{"no room", `{"kind":"header","header":{"format":"` + ArchiveFormat + `","version":1,"room_name":"room"}}` + "\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ImportRoom(strings.NewReader(test.archive), "imported", false); err == nil {
+				t.Errorf("imported an invalid archive")
+			}
+		})
+	}
+}
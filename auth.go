@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TokenVerifier verifies the ID tokens clients announce with.
+type TokenVerifier interface {
+	// VerifyIDToken returns the UID of the user an ID token was issued to, or an error if it isn't valid.
+	VerifyIDToken(idToken string) (string, error)
+}
+
+// verifier verifies the ID tokens clients announce with.
+var verifier TokenVerifier
+
+// loadAuth configures how ID tokens are verified, with firebase auth unless ENV is local.
+func loadAuth() {
+	if os.Getenv("ENV") == "local" {
+		verifier = localVerifier{}
+		log.Warnf("ENV is local, ID tokens are not verified")
+		return
+	}
+	fb, ok := userDirectory.(*Firebase)
+	if !ok || fb.authClient == nil {
+		log.Fatalf("%T can't verify ID tokens, set ENV=local to run without firebase auth", userDirectory)
+	}
+	verifier = fb
+	log.Infof("verifying ID tokens with firebase")
+}
+
+// localVerifier is a fake verifier for local development and tests, which takes any ID token to be the UID itself.
+type localVerifier struct{}
+
+// VerifyIDToken returns the ID token as the UID.
+func (localVerifier) VerifyIDToken(idToken string) (string, error) {
+	if idToken == "" {
+		return "", fmt.Errorf("empty ID token")
+	}
+	return idToken, nil
+}
+
+// authenticate verifies the ID token a client announced with, returning the UID to bind to the client.
+// Clients announcing with a protocol version before AuthProtocolVersion, only served if MIN_PROTOCOL_VERSION allows,
+// have no ID token, so the user ID they claim is trusted.
+// A client may not announce as a different user than it already has.
+func authenticate(c *Client, m *AnnounceMessage) (string, *ErrorInfo) {
+	if c.ProtocolVersion < AuthProtocolVersion {
+		if m.UserID == "" {
+			return "", NewError(ErrCodeUnauthenticated, TypeAnnounce, "a user ID is required to announce")
+		}
+		if c.UserID != "" && c.UserID != m.UserID {
+			return "", NewError(ErrCodeUnauthenticated, TypeAnnounce, "already announced as another user")
+		}
+		return m.UserID, nil
+	}
+	if m.IDToken == "" {
+		return "", NewError(ErrCodeUnauthenticated, TypeAnnounce, "an ID token is required to announce")
+	}
+	uid, err := verifier.VerifyIDToken(m.IDToken)
+	if err != nil {
+		log.Warnf("unable to verify ID token for user \"%s\": %s", m.UserID, err)
+		return "", NewError(ErrCodeInvalidToken, TypeAnnounce, "invalid ID token: %s", err)
+	}
+	if m.UserID != "" && m.UserID != uid {
+		log.Warnf("user \"%s\" announced with an ID token for user \"%s\"", m.UserID, uid)
+		return "", NewError(ErrCodeUnauthenticated, TypeAnnounce, "user ID %s doesn't match the ID token", m.UserID)
+	}
+	if c.UserID != "" && c.UserID != uid {
+		return "", NewError(ErrCodeUnauthenticated, TypeAnnounce, "already announced as another user")
+	}
+	return uid, nil
+}
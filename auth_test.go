@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// expiredVerifier is a verifier that rejects every ID token.
+type expiredVerifier struct{}
+
+// VerifyIDToken rejects the ID token.
+func (expiredVerifier) VerifyIDToken(idToken string) (string, error) {
+	return "", fmt.Errorf("ID token has expired")
+}
+
+func TestAuthenticate(t *testing.T) {
+	defer func() { verifier = localVerifier{} }()
+
+	tests := []struct {
+		name     string
+		verifier TokenVerifier
+		version  int
+		announce *AnnounceMessage
+		userID   string // Already bound to the client
+		uid      string
+		code     string
+	}{
+		{"token", localVerifier{}, AuthProtocolVersion, &AnnounceMessage{IDToken: "alice"}, "", "alice", ""},
+		{"token matching user ID", localVerifier{}, AuthProtocolVersion, &AnnounceMessage{UserID: "alice", IDToken: "alice"}, "", "alice", ""},
+		{"no token", localVerifier{}, AuthProtocolVersion, &AnnounceMessage{UserID: "alice"}, "", "", ErrCodeUnauthenticated},
+		{"expired token", expiredVerifier{}, AuthProtocolVersion, &AnnounceMessage{IDToken: "alice"}, "", "", ErrCodeInvalidToken},
+		{"token for another user", localVerifier{}, AuthProtocolVersion, &AnnounceMessage{UserID: "alice", IDToken: "bob"}, "", "", ErrCodeUnauthenticated},
+		{"reannounce", localVerifier{}, AuthProtocolVersion, &AnnounceMessage{IDToken: "alice"}, "alice", "alice", ""},
+		{"reannounce as another user", localVerifier{}, AuthProtocolVersion, &AnnounceMessage{IDToken: "bob"}, "alice", "", ErrCodeUnauthenticated},
+		{"legacy trusts user ID", localVerifier{}, LegacyProtocolVersion, &AnnounceMessage{UserID: "alice"}, "", "alice", ""},
+		{"legacy without user ID", localVerifier{}, LegacyProtocolVersion, &AnnounceMessage{}, "", "", ErrCodeUnauthenticated},
+		{"legacy reannounce as another user", localVerifier{}, LegacyProtocolVersion, &AnnounceMessage{UserID: "bob"}, "alice", "", ErrCodeUnauthenticated},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifier = test.verifier
+			c := newTestClient(test.userID)
+			c.ProtocolVersion = test.version
+			uid, errInfo := authenticate(c, test.announce)
+			code := ""
+			if errInfo != nil {
+				code = errInfo.Code
+			}
+			if code != test.code {
+				t.Errorf("got error %v, want %s", errInfo, test.code)
+			}
+			if uid != test.uid {
+				t.Errorf("got UID %s, want %s", uid, test.uid)
+			}
+		})
+	}
+}
+
+func TestAnnounceHandlerProtocolVersions(t *testing.T) {
+	verifier = localVerifier{}
+	defer func(min int) { minProtocolVersion = min }(minProtocolVersion)
+
+	tests := []struct {
+		name       string
+		minVersion int
+		announce   *AnnounceMessage
+		upgrade    bool
+		code       string
+		uid        string
+	}{
+		{"legacy client must upgrade", AuthProtocolVersion, &AnnounceMessage{UserID: "alice"}, true, ErrCodeUpgradeRequired, ""},
+		{"legacy client allowed", LegacyProtocolVersion, &AnnounceMessage{UserID: "alice"}, false, "", "alice"},
+		{"current client", AuthProtocolVersion, &AnnounceMessage{ProtocolVersion: ProtocolVersion, IDToken: "alice"}, false, "", "alice"},
+		{"current client without token", LegacyProtocolVersion, &AnnounceMessage{ProtocolVersion: ProtocolVersion, UserID: "alice"}, false, ErrCodeUnauthenticated, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			minProtocolVersion = test.minVersion
+			users = NewUserIndex()
+			c := newTestClient("")
+			res, _ := AnnounceHandler(c, test.announce)
+			code := ""
+			if res.Error != nil {
+				code = res.Error.Code
+			}
+			if code != test.code {
+				t.Errorf("got error %v, want %s", res.Error, test.code)
+			}
+			if res.UpgradeRequired != test.upgrade {
+				t.Errorf("got upgradeRequired %t, want %t", res.UpgradeRequired, test.upgrade)
+			}
+			if c.UserID != test.uid {
+				t.Errorf("client bound to user %s, want %s", c.UserID, test.uid)
+			}
+		})
+	}
+}
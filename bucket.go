@@ -0,0 +1,146 @@
+package main
+
+import (
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// bucketChunk is the part of a batch of operations written to a single bucket.
+type bucketChunk struct {
+	Bucket int
+	Ops    []bson.M
+	Bytes  int
+}
+
+// RebalanceResult describes the buckets a rebalance split.
+type RebalanceResult struct {
+	RoomName      string `json:"roomName"`
+	BucketsBefore int    `json:"bucketsBefore"`
+	BucketsAfter  int    `json:"bucketsAfter"`
+	BucketsSplit  int    `json:"bucketsSplit"`
+}
+
+// opSize returns the size of an operation when stored in a bucket.
+func opSize(op bson.M) int {
+	b, err := bson.Marshal(op)
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
+
+// bucketHasRoom returns whether an operation of opBytes fits in a bucket holding count operations of bytes.
+// An empty bucket always takes the operation, however large.
+func bucketHasRoom(count int, bytes int, opBytes int, maxOps int, maxBytes int) bool {
+	if count == 0 {
+		return true
+	}
+	return count < maxOps && bytes+opBytes <= maxBytes
+}
+
+// planBatch stamps a batch of operations committed in a room, and splits it into the buckets it is written to,
+// filling the room's current bucket (holding bucketCount operations of bucketBytes) before rolling over to new buckets.
+// Returns the chunks, and the room's last sequence number and number of buckets after the batch.
+func planBatch(room *RoomDoc, bucketCount int, bucketBytes int, ops []bson.M, maxOps int, maxBytes int) ([]bucketChunk, int64, int) {
+	seq := room.LastSeq
+	bucket := room.NumBuckets
+	commitTime := nowMillis()
+	chunks := []bucketChunk{}
+	for _, op := range ops {
+		seq++
+		stampOperation(op, seq, bucket, commitTime)
+		size := opSize(op)
+		if !bucketHasRoom(bucketCount, bucketBytes, size, maxOps, maxBytes) {
+			bucket++
+			bucketCount = 0
+			bucketBytes = 0
+			stampOperation(op, seq, bucket, commitTime)
+		}
+		if len(chunks) == 0 || chunks[len(chunks)-1].Bucket != bucket {
+			chunks = append(chunks, bucketChunk{Bucket: bucket})
+		}
+		chunk := &chunks[len(chunks)-1]
+		chunk.Ops = append(chunk.Ops, op)
+		chunk.Bytes += size
+		bucketCount++
+		bucketBytes += size
+	}
+
+	// A bucket full by count rolls over immediately, so num_buckets is always the bucket to write to next
+	if bucketCount >= maxOps {
+		bucket++
+	}
+	return chunks, seq, bucket
+}
+
+// rebalanceBuckets splits the buckets over the count or byte limits into new bucket documents, renumbering the
+// buckets after them.
+// Operations from different buckets are never merged, so operations only move to later buckets and existing bucket
+// cursors stay valid. Returns the new buckets, and how many buckets were added before and including each old bucket.
+func rebalanceBuckets(buckets []OpBucketDoc, maxOps int, maxBytes int) ([]OpBucketDoc, map[int]int) {
+	rebalanced := []OpBucketDoc{}
+	shifts := make(map[int]int)
+	shift := 0
+	for _, bucketDoc := range buckets {
+		bucket := bucketDoc.Bucket + shift
+		current := OpBucketDoc{ID: primitive.NewObjectID(), RoomName: bucketDoc.RoomName, Bucket: bucket, Ops: []bson.M{}}
+		for _, op := range bucketDoc.Ops {
+			size := opSize(op)
+			if !bucketHasRoom(current.Count, current.Bytes, size, maxOps, maxBytes) {
+				rebalanced = append(rebalanced, current)
+				bucket++
+				shift++
+				current = OpBucketDoc{ID: primitive.NewObjectID(), RoomName: bucketDoc.RoomName, Bucket: bucket, Ops: []bson.M{}}
+			}
+			if bucket != bucketDoc.Bucket {
+				op[OpKeyBucket] = bucket
+			}
+			current.Ops = append(current.Ops, op)
+			current.Count++
+			current.Bytes += size
+		}
+		rebalanced = append(rebalanced, current)
+		shifts[bucketDoc.Bucket] = shift
+	}
+	return rebalanced, shifts
+}
+
+// sortedBuckets returns the old bucket numbers of a rebalance's shifts in ascending order.
+func sortedBuckets(shifts map[int]int) []int {
+	buckets := make([]int, 0, len(shifts))
+	for old := range shifts {
+		buckets = append(buckets, old)
+	}
+	sort.Ints(buckets)
+	return buckets
+}
+
+// countSplitBuckets returns how many buckets a rebalance split, given how many buckets were added before and including
+// each old bucket.
+// Shifts only grow with the bucket number, so a bucket was split if its shift is larger than the previous bucket's.
+func countSplitBuckets(shifts map[int]int) int {
+	split := 0
+	previous := 0
+	for _, old := range sortedBuckets(shifts) {
+		if shifts[old] > previous {
+			split++
+		}
+		previous = shifts[old]
+	}
+	return split
+}
+
+// shiftBucket returns the number of a bucket after a rebalance, given how many buckets were added before and
+// including each old bucket.
+func shiftBucket(bucket int, shifts map[int]int) int {
+	buckets := sortedBuckets(shifts)
+
+	// The bucket moves by the shift of the last old bucket at or before it
+	i := sort.SearchInts(buckets, bucket+1)
+	if i == 0 {
+		return bucket
+	}
+	return bucket + shifts[buckets[i-1]]
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// newTestOperations returns n operations, stamped in bucket if it is not 0.
+func newTestOperations(n int, bucket int) []bson.M {
+	ops := []bson.M{}
+	for i := 0; i < n; i++ {
+		op := bson.M{"type": "ADD_STEP"}
+		if bucket != 0 {
+			stampOperation(op, int64(i+1), bucket, 0)
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+func TestPlanBatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		room        RoomDoc
+		bucketCount int
+		n           int
+		maxOps      int
+		maxBytes    int
+		chunks      []int // Operations written to each bucket, starting at the room's current bucket
+		lastSeq     int64
+		numBuckets  int
+	}{
+		{"empty batch", RoomDoc{LastSeq: 2, NumBuckets: 1}, 2, 0, 5, 1000, []int{}, 2, 1},
+		{"fills current bucket", RoomDoc{LastSeq: 3, NumBuckets: 1}, 3, 1, 5, 1000, []int{1}, 4, 1},
+		{"rolls over", RoomDoc{LastSeq: 3, NumBuckets: 1}, 3, 4, 5, 1000, []int{2, 2}, 7, 2},
+		{"full bucket rolls over", RoomDoc{LastSeq: 4, NumBuckets: 1}, 4, 1, 5, 1000, []int{1}, 5, 2},
+		{"byte limit", RoomDoc{NumBuckets: 1}, 0, 3, 100, 1, []int{1, 1, 1}, 3, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			room := test.room
+			chunks, lastSeq, numBuckets := planBatch(&room, test.bucketCount, 0, newTestOperations(test.n, 0), test.maxOps, test.maxBytes)
+			if lastSeq != test.lastSeq || numBuckets != test.numBuckets {
+				t.Errorf("got last seq %d and %d buckets, want %d and %d", lastSeq, numBuckets, test.lastSeq, test.numBuckets)
+			}
+			if len(chunks) != len(test.chunks) {
+				t.Fatalf("got %d chunks, want %d", len(chunks), len(test.chunks))
+			}
+			seq := test.room.LastSeq
+			for i, chunk := range chunks {
+				if chunk.Bucket != test.room.NumBuckets+i || len(chunk.Ops) != test.chunks[i] {
+					t.Errorf("chunk %d has %d operations in bucket %d, want %d in bucket %d",
+						i, len(chunk.Ops), chunk.Bucket, test.chunks[i], test.room.NumBuckets+i)
+				}
+				for _, op := range chunk.Ops {
+					seq++
+					if opSeq(op) != seq || int(opInt(op, OpKeyBucket)) != chunk.Bucket {
+						t.Errorf("operation stamped seq %d in bucket %v, want seq %d in bucket %d", opSeq(op), op[OpKeyBucket], seq, chunk.Bucket)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestKeyedMutex(t *testing.T) {
+	k := NewKeyedMutex()
+	unlock := k.Lock("a")
+
+	// Other keys don't wait for the lock
+	k.Lock("b")()
+
+	locked := make(chan struct{})
+	go func() {
+		k.Lock("a")()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("locked a key that was already held")
+	case <-time.After(10 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+
+	// Unused locks are freed
+	k.Mutex.Lock()
+	defer k.Mutex.Unlock()
+	if len(k.m) != 0 {
+		t.Errorf("got %d locks after unlocking, want 0", len(k.m))
+	}
+}
+
+func TestRebalanceBuckets(t *testing.T) {
+	buckets := []OpBucketDoc{
+		{Bucket: 1, Ops: newTestOperations(3, 1)},
+		{Bucket: 2, Ops: newTestOperations(1, 2)},
+		{Bucket: 3, Ops: newTestOperations(5, 3)},
+	}
+	rebalanced, shifts := rebalanceBuckets(buckets, 2, 1000)
+
+	counts := []int{2, 1, 1, 2, 2, 1}
+	if len(rebalanced) != len(counts) {
+		t.Fatalf("got %d buckets, want %d", len(rebalanced), len(counts))
+	}
+	for i, bucketDoc := range rebalanced {
+		if bucketDoc.Bucket != i+1 || bucketDoc.Count != counts[i] || len(bucketDoc.Ops) != counts[i] {
+			t.Errorf("got bucket %d with %d operations, want bucket %d with %d", bucketDoc.Bucket, bucketDoc.Count, i+1, counts[i])
+		}
+		for _, op := range bucketDoc.Ops {
+			if int(opInt(op, OpKeyBucket)) != bucketDoc.Bucket {
+				t.Errorf("operation in bucket %d stamped bucket %v", bucketDoc.Bucket, op[OpKeyBucket])
+			}
+		}
+	}
+
+	want := map[int]int{1: 1, 2: 1, 3: 3}
+	for old, shift := range want {
+		if shifts[old] != shift {
+			t.Errorf("got shift %d for bucket %d, want %d", shifts[old], old, shift)
+		}
+	}
+	if split := countSplitBuckets(shifts); split != 2 {
+		t.Errorf("got %d split buckets, want 2", split)
+	}
+}
+
+func TestShiftBucket(t *testing.T) {
+	tests := []struct {
+		name    string
+		shifts  map[int]int
+		bucket  int
+		shifted int
+		split   int
+	}{
+		{"no buckets", map[int]int{}, 3, 3, 0},
+		{"nothing split", map[int]int{1: 0, 2: 0}, 2, 2, 0},
+		{"before the first bucket", map[int]int{1: 1, 2: 1, 3: 3}, 0, 0, 2},
+		{"split bucket", map[int]int{1: 1, 2: 1, 3: 3}, 1, 2, 2},
+		{"after a split bucket", map[int]int{1: 1, 2: 1, 3: 3}, 2, 3, 2},
+		{"last bucket", map[int]int{1: 1, 2: 1, 3: 3}, 3, 6, 2},
+		{"next bucket", map[int]int{1: 1, 2: 1, 3: 3}, 4, 7, 2},
+		{"archived buckets", map[int]int{5: 0, 6: 2, 9: 2}, 7, 9, 1},
+		{"before archived buckets", map[int]int{5: 0, 6: 2, 9: 2}, 2, 2, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if shifted := shiftBucket(test.bucket, test.shifts); shifted != test.shifted {
+				t.Errorf("got bucket %d shifted to %d, want %d", test.bucket, shifted, test.shifted)
+			}
+			if split := countSplitBuckets(test.shifts); split != test.split {
+				t.Errorf("got %d split buckets, want %d", split, test.split)
+			}
+		})
+	}
+}
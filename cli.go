@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Subcommands that can be run instead of the server
+const (
+	CommandExport    = "export"
+	CommandImport    = "import"
+	CommandSchema    = "schema"
+	CommandRebalance = "rebalance"
+)
+
+// runCommand runs a subcommand given its arguments, returning false if args are not a known subcommand.
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	var err error
+	switch args[0] {
+	case CommandExport:
+		err = exportCommand(args[1:])
+	case CommandImport:
+		err = importCommand(args[1:])
+	case CommandSchema:
+		err = schemaCommand(args[1:])
+	case CommandRebalance:
+		err = rebalanceCommand(args[1:])
+	default:
+		return false
+	}
+	if err != nil {
+		log.Fatalf("%s failed: %s", args[0], err)
+	}
+	return true
+}
+
+// exportCommand exports a room archive to a file or stdout.
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet(CommandExport, flag.ExitOnError)
+	roomName := flags.String("room", "", "name of the room to export (required)")
+	out := flags.String("out", "", "file to write the archive to (default stdout)")
+	compress := flags.Bool("gzip", false, "gzip the archive")
+	flags.Parse(args)
+	if *roomName == "" {
+		flags.Usage()
+		return fmt.Errorf("-room is required")
+	}
+
+	connect()
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return ExportRoom(w, *roomName, *compress)
+}
+
+// importCommand imports a room archive from a file or stdin.
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet(CommandImport, flag.ExitOnError)
+	in := flags.String("in", "", "file to read the archive from (default stdin)")
+	roomName := flags.String("room", "", "name to import the room as (default the archived room name)")
+	withMetadata := flags.Bool("metadata", false, "also write the archived firestore room metadata")
+	flags.Parse(args)
+
+	connect()
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	room, err := ImportRoom(r, *roomName, *withMetadata)
+	if err != nil {
+		return err
+	}
+	log.Infof("imported room %s", room.RoomName)
+	return nil
+}
+
+// schemaCommand writes the websocket protocol JSON Schema to a file or stdout.
+func schemaCommand(args []string) error {
+	flags := flag.NewFlagSet(CommandSchema, flag.ExitOnError)
+	out := flags.String("out", "", "file to write the schema to (default stdout)")
+	flags.Parse(args)
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(GenerateSchema())
+}
+
+// rebalanceCommand splits a room's operation buckets that are over the count or byte limits.
+func rebalanceCommand(args []string) error {
+	flags := flag.NewFlagSet(CommandRebalance, flag.ExitOnError)
+	roomName := flags.String("room", "", "name of the room to rebalance (required)")
+	flags.Parse(args)
+	if *roomName == "" {
+		flags.Usage()
+		return fmt.Errorf("-room is required")
+	}
+
+	connect()
+	result, err := database.RebalanceOperations(*roomName)
+	if err != nil {
+		return err
+	}
+	log.Infof("rebalanced room %s: split %d buckets, %d buckets now %d", result.RoomName, result.BucketsSplit,
+		result.BucketsBefore, result.BucketsAfter)
+	return nil
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	"go.mongodb.org/mongo-driver/bson"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -14,6 +16,15 @@ import (
 // clients contains all existing clients.
 var clients = NewClientMap()
 
+// InboxSize is how many received messages may wait to be dispatched before the reader stops reading.
+const InboxSize = 64
+
+// inboundMessage is a received message waiting to be dispatched.
+type inboundMessage struct {
+	codec Codec
+	b     []byte
+}
+
 // Client is a wrapper around the websocket connection
 type Client struct {
 	// Connection ID for the client.
@@ -22,6 +33,19 @@ type Client struct {
 	// User ID for the client.
 	UserID string
 
+	// Protocol version negotiated on announce.
+	ProtocolVersion int
+
+	// Capabilities the client advertised on announce, read by other members' goroutines.
+	// The map is replaced rather than modified on each announce.
+	capabilities atomic.Value
+
+	// Codec outbound messages are encoded with, selected by subprotocol or on announce.
+	codec atomic.Value
+
+	// Flag for whether the client announced a protocol version too old to serve.
+	upgradeRequired bool
+
 	// The room the client is a member of.
 	Room *Room
 
@@ -31,31 +55,52 @@ type Client struct {
 	// Timeout for channel operations in milliseconds.
 	chanTimeout int
 
-	// Buffered channel of outbound messages.
-	send chan interface{}
+	// Bounded queue of outbound messages.
+	send *outbox
 
-	// Flag for whether the send chan is open
-	sendOpen bool
+	// Received messages, dispatched one at a time in the order received.
+	inbox chan inboundMessage
 
 	// Channel to wait on for full state update.
-	stateUpdate chan bson.M
+	stateUpdate chan *StateMessage
+
+	// When the client last sent a message, in nanoseconds since the epoch.
+	lastActivity int64
+
+	// Token the client can resume its session with after reconnecting.
+	sessionToken string
+
+	// Set to 1 while the connection has dropped and the session is held for the client to resume.
+	detached int32
+
+	// Set to 1 when the connection is closed in favor of a newer one for the same user.
+	takenOver int32
+
+	// Close frame written when the send queue is closed, empty if unset.
+	closeMessage atomic.Value
 }
 
-// NewClient creates and starts a new Client.
-func NewClient(conn *websocket.Conn) *Client {
+// NewClient creates and starts a new Client, encoding outbound messages with codec.
+func NewClient(conn *websocket.Conn, codec Codec) *Client {
 	c := &Client{
-		connID:      uuid.New().String(),
-		UserID:      "", // To be populated on TypeAnnounce
-		Room:        nil,
-		conn:        conn,
-		chanTimeout: 500,
-		send:        make(chan interface{}),
-		sendOpen:    true,
-		stateUpdate: make(chan bson.M),
+		connID:       uuid.New().String(),
+		UserID:       "", // To be populated on TypeAnnounce
+		Room:         nil,
+		conn:         conn,
+		chanTimeout:  500,
+		send:         newOutbox(sendQueueSize, slowConsumerPolicy),
+		inbox:        make(chan inboundMessage, InboxSize),
+		stateUpdate:  make(chan *StateMessage),
+		lastActivity: time.Now().UnixNano(),
 	}
+	c.SetCapabilities(nil)
+	c.SetCodec(codec)
+	configureConn(conn)
 	go c.reader()
+	go c.dispatcher()
 	go c.writer()
 	clients.Set(c, true)
+	metrics.ConnectionOpened()
 	return c
 }
 
@@ -63,13 +108,25 @@ func NewClient(conn *websocket.Conn) *Client {
 func (c *Client) Close() {
 	log.Infof("closing connection %s", c.connID)
 
-	// Close send chan
-	if c.sendOpen {
-		c.sendOpen = false
-		close(c.send)
+	// Close send queue
+	c.send.Close()
+	clients.Delete(c)
+	if c.UserID != "" {
+		users.Remove(c.UserID, c)
 	}
 
-	// Clean up room presence
+	// Hold the session and room presence for the client to resume, if possible
+	if c.detach() {
+		return
+	}
+	if c.sessionToken != "" {
+		sessions.Take(c.sessionToken, c)
+	}
+	c.leaveRoom()
+}
+
+// leaveRoom cleans up the client's room presence, updating the other members.
+func (c *Client) leaveRoom() {
 	if c.Room != nil {
 		// Decrement room num_members
 		doc, err := database.UpdateRoomNumMembers(c.Room.RoomName, -1)
@@ -77,52 +134,96 @@ func (c *Client) Close() {
 			log.Errorf("[DATA OUT OF SYNC] unable to decrement num_members for room %s: %s", c.Room.RoomName, err)
 		} else {
 			// Update clients with num_members
-			c.Room.Broadcast(bson.M{
-				"type":       TypeNumMembersUpdate,
-				"numMembers": doc.NumMembers,
-			}, c)
+			c.Room.Broadcast(NewNumMembersUpdateMessage(doc.NumMembers), c)
 		}
 		c.Room.Members.Delete(c)
 		c.Room = nil
 	}
-	clients.Delete(c)
 }
 
-// Send sends a message to the connected websocket client.
+// HasCapability returns whether the client advertised a capability on announce.
+func (c *Client) HasCapability(capability string) bool {
+	capabilities, _ := c.capabilities.Load().(map[string]bool)
+	return capabilities[capability]
+}
+
+// SetCapabilities sets the capabilities the client advertised on announce, replacing any advertised before.
+func (c *Client) SetCapabilities(names []string) {
+	capabilities := make(map[string]bool)
+	for _, capability := range names {
+		capabilities[capability] = true
+	}
+	c.capabilities.Store(capabilities)
+}
+
+// codecValue wraps a Codec so codecs of different types can be stored in the same atomic.Value.
+type codecValue struct {
+	Codec
+}
+
+// Codec returns the codec outbound messages are encoded with.
+func (c *Client) Codec() Codec {
+	return c.codec.Load().(codecValue).Codec
+}
+
+// SetCodec sets the codec outbound messages are encoded with, starting with the next message written.
+func (c *Client) SetCodec(codec Codec) {
+	c.codec.Store(codecValue{codec})
+}
+
+// Send queues a message for the connected websocket client without blocking.
 func (c *Client) Send(v interface{}) error {
-	if c.sendOpen {
-		select {
-		case c.send <- v:
-			return nil
-		case <-time.After(time.Duration(c.chanTimeout) * time.Millisecond):
-			return fmt.Errorf("unable to send message (send channel timeout)")
+	if c.isDetached() {
+		// Operations are replayed from the store when the session resumes
+		return nil
+	}
+	policy, err := c.send.Push(v)
+	if err != nil {
+		return err
+	}
+	if policy != "" {
+		room := c.Room
+		if room != nil {
+			room.SlowConsumers.Count(policy)
+		}
+		if policy == SlowConsumerDisconnect {
+			return fmt.Errorf("disconnecting slow consumer %s (user \"%s\")", c.connID, c.UserID)
 		}
+		log.Debugf("send queue full for %s, applied %s", c.connID, policy)
 	}
-	return fmt.Errorf("attempted send on closed send channel")
+	return nil
 }
 
-// WaitForState waits for the full state to be provided to the client from another.
-func (c *Client) WaitForState() (bson.M, error) {
+// RequestState asks a peer in the client's room for the full state, and waits for it to be provided.
+func (c *Client) RequestState(peer *Client, timeout time.Duration) (*StateMessage, error) {
 	if c.Room == nil {
 		return nil, fmt.Errorf("client not in room to receive state")
 	}
+	if peer.isDetached() {
+		return nil, fmt.Errorf("peer is disconnected")
+	}
 	c.Room.NeedsState.Set(c, true)
 	defer func() {
 		c.Room.NeedsState.Delete(c)
 	}()
 
+	err := peer.Send(NewRequestStateMessage(c.Room.RoomName))
+	if err != nil {
+		return nil, fmt.Errorf("unable to request full state: %w", err)
+	}
+
 	select {
-	case state := <-c.stateUpdate:
-		return state, nil
-	case <-time.After(time.Duration(c.chanTimeout) * time.Millisecond):
+	case m := <-c.stateUpdate:
+		return m, nil
+	case <-time.After(timeout):
 		return nil, fmt.Errorf("did not receive full state (receive channel timeout)")
 	}
 }
 
 // ReceiveState receives the full state of a room.
-func (c *Client) ReceiveState(state bson.M) {
+func (c *Client) ReceiveState(m *StateMessage) {
 	select {
-	case c.stateUpdate <- state:
+	case c.stateUpdate <- m:
 	case <-time.After(time.Duration(c.chanTimeout) * time.Millisecond):
 		log.Errorf("unable to send state (send channel timeout)")
 	}
@@ -131,36 +232,117 @@ func (c *Client) ReceiveState(state bson.M) {
 // reader loops over and dispatches incoming messages.
 func (c *Client) reader() {
 	for {
-		_, m, err := c.conn.ReadMessage()
+		frameType, m, err := c.conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			var netErr net.Error
+			if err == websocket.ErrReadLimit {
+				log.Warnf("connection %s sent a message larger than %d bytes", c.connID, maxMessageSize)
+			} else if errors.As(err, &netErr) && netErr.Timeout() {
+				log.Infof("reaping connection %s, no pong within %s", c.connID, pongWait)
+				metrics.ConnectionReaped(ReapPongTimeout)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Errorf("unexpected close error: %v", err)
 			}
-			c.Close()
+			// The dispatcher cleans up the client once it has handled the messages already received
+			close(c.inbox)
 			break
 		}
-		log.Debugf("received message: %s", m)
-		go dispatch(c, m)
+
+		// Any message shows the connection is alive
+		atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+
+		codec := codecForFrame(frameType)
+		if codec.FrameType() == websocket.TextMessage {
+			log.Debugf("received message: %s", m)
+		} else {
+			log.Debugf("received %s message (%d bytes)", codec.Name(), len(m))
+		}
+		c.inbox <- inboundMessage{codec: codec, b: m}
+	}
+}
+
+// dispatcher dispatches received messages in order, so messages from the same client never race each other.
+// When the reader stops, the client is closed after the messages already received are dispatched, so no handler runs
+// on a closed client.
+func (c *Client) dispatcher() {
+	for in := range c.inbox {
+		dispatch(c, in.codec, in.b)
 	}
+	c.Close()
+	metrics.ConnectionClosed()
 }
 
-// writer loops over the send channel and sends messages.
+// writer loops over the send channel and sends messages, pinging the client and reaping the connection when idle.
 func (c *Client) writer() {
-	for {
-		m, ok := <-c.send
-		if !ok {
-			// Send channel has been closed
-			c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-			return
-		}
+	pingTicker := time.NewTicker(pingPeriod())
+	defer pingTicker.Stop()
 
-		// Write message as JSON
-		err := c.conn.WriteJSON(m)
-		if err != nil {
-			if err == websocket.ErrCloseSent {
-				// Don't log error on closed channel
+	// Check for idleness twice per timeout, if enabled
+	var idleCheck <-chan time.Time
+	if idleTimeout > 0 {
+		idleTicker := time.NewTicker(idleTimeout / 2)
+		defer idleTicker.Stop()
+		idleCheck = idleTicker.C
+	}
+
+	for {
+		select {
+		case <-c.send.Ready():
+			queue, closed := c.send.Drain()
+			for _, m := range queue {
+				// Write encoded message
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				codec := c.Codec()
+				b, err := codec.Marshal(m)
+				if err != nil {
+					log.Errorf("unable to encode %s message: %s", codec.Name(), err)
+					continue
+				}
+				err = c.conn.WriteMessage(codec.FrameType(), b)
+				if err != nil {
+					c.writeFailed(err)
+					return
+				}
+			}
+			if closed {
+				// Send queue has been closed
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				closeMessage, _ := c.closeMessage.Load().([]byte)
+				c.conn.WriteMessage(websocket.CloseMessage, closeMessage)
+				c.conn.Close()
+				return
+			}
+		case <-pingTicker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err := c.conn.WriteMessage(websocket.PingMessage, nil)
+			if err != nil {
+				c.writeFailed(err)
+				return
+			}
+		case <-idleCheck:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActivity)))
+			if idle >= idleTimeout {
+				log.Infof("reaping connection %s, idle for %s", c.connID, idle)
+				metrics.ConnectionReaped(ReapIdleTimeout)
+				c.conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "idle timeout"), time.Now().Add(writeWait))
+				c.conn.Close() // The reader fails and cleans up the client
+				return
 			}
-			log.Errorf("error writing message: %s", err)
 		}
 	}
 }
+
+// writeFailed closes the connection after a write error, which fails the reader so it cleans up the client.
+// The connection can't be written to again after a failed write.
+func (c *Client) writeFailed(err error) {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		log.Infof("reaping connection %s, unable to write within %s", c.connID, writeWait)
+		metrics.ConnectionReaped(ReapWriteTimeout)
+	} else if err != websocket.ErrCloseSent {
+		log.Errorf("error writing message: %s", err)
+	}
+	c.conn.Close()
+}
@@ -77,19 +77,7 @@ firebase.auth().onAuthStateChanged(user => {
 
             // Announce this user
             socket.addEventListener("open", () => {
-                socket.sendWithResponse({
-                    "id": uuidv4(),
-                    "type": "announce",
-                    "userID": user.uid
-                })
-                    .then(res => {
-                        if(res.error) {
-                            // Client already connected
-                            alert("You're already logged in in another tab.");
-                            $("#content").remove();
-                        }
-                    })
-                    .catch(error => console.log("unable to announce:", error));
+                announce(user, false).catch(error => console.log("unable to announce:", error));
             });
         }
     } else {
@@ -100,6 +88,37 @@ firebase.auth().onAuthStateChanged(user => {
     }
 });
 
+// Announce a user, announcing again with a refreshed ID token if the server rejects it
+function announce(user, refreshToken) {
+    return user.getIdToken(refreshToken)
+        .then(idToken => socket.sendWithResponse({
+            "id": uuidv4(),
+            "type": "announce",
+            "protocolVersion": 3,
+            "userID": user.uid,
+            "idToken": idToken
+        }))
+        .then(res => {
+            if (!res.error) return;
+            switch (res.error.code) {
+                case "INVALID_TOKEN":
+                    // The cached ID token may have expired
+                    if (!refreshToken) return announce(user, true);
+                    console.log("unable to announce, ID token rejected:", res.error.message);
+                    break;
+                case "ALREADY_CONNECTED":
+                    alert("You're already logged in in another tab.");
+                    $("#content").remove();
+                    break;
+                case "UPGRADE_REQUIRED":
+                    alert("A new version is available, reload the page to continue.");
+                    break;
+                default:
+                    console.log("unable to announce:", res.error.message);
+            }
+        });
+}
+
 // Sync rooms
 rooms.where('active', '==', true).onSnapshot(snapshot => {
     if (!snapshot.size) console.log("No rooms.");
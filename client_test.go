@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestDispatcherClosesAfterInbox(t *testing.T) {
+	newTestRoom(t, "room", "other", bson.M{})
+	defer func(grace time.Duration) { sessionGracePeriod = grace }(sessionGracePeriod)
+	sessionGracePeriod = 0
+
+	// The connection drops with an enterRoom still waiting to be dispatched
+	c := newTestClient("user")
+	c.inbox <- inboundMessage{codec: jsonCodec{}, b: []byte(`{"id":"1","type":"enterRoom","roomName":"room"}`)}
+	close(c.inbox)
+	c.dispatcher()
+
+	room, _ := rooms.Get("room")
+	if _, ok := room.Members.Get(c); ok {
+		t.Errorf("closed client is still a member of the room")
+	}
+	doc, err := database.GetRoom("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.NumMembers != 0 {
+		t.Errorf("got num_members %d after the client closed, want 0", doc.NumMembers)
+	}
+	if c.Room != nil {
+		t.Errorf("closed client is still in room %s", c.Room.RoomName)
+	}
+}
+
+func TestCapabilitiesReannounce(t *testing.T) {
+	verifier = localVerifier{}
+	users = NewUserIndex()
+	c := newTestClient("")
+
+	// Other members read the client's capabilities while it announces again
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c.HasCapability(CapPeerState)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		AnnounceHandler(c, &AnnounceMessage{ProtocolVersion: ProtocolVersion, IDToken: "alice", Capabilities: []string{CapPeerState}})
+	}
+	<-done
+	if !c.HasCapability(CapPeerState) || c.HasCapability(CapSnapshots) {
+		t.Errorf("capabilities don't match the last announce")
+	}
+	AnnounceHandler(c, &AnnounceMessage{ProtocolVersion: ProtocolVersion, IDToken: "alice", Capabilities: []string{CapSnapshots}})
+	if c.HasCapability(CapPeerState) || !c.HasCapability(CapSnapshots) {
+		t.Errorf("capabilities weren't replaced on announce")
+	}
+}
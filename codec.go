@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Wire encodings, also offered as websocket subprotocols
+const (
+	EncodingJSON    = "json"
+	EncodingMsgpack = "msgpack"
+)
+
+// SubprotocolPrefix prefixes the encoding name in websocket subprotocols, e.g. "nime2020.msgpack".
+const SubprotocolPrefix = "nime2020."
+
+// Codec encodes and decodes websocket messages in a single wire encoding.
+type Codec interface {
+	// Name is the encoding name clients select the codec with.
+	Name() string
+
+	// FrameType is the websocket message type the codec's messages are sent as.
+	FrameType() int
+
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(b []byte, v interface{}) error
+}
+
+// jsonCodec encodes messages as JSON text frames.
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                            { return EncodingJSON }
+func (jsonCodec) FrameType() int                          { return websocket.TextMessage }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)   { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(b []byte, v interface{}) error { return json.Unmarshal(b, v) }
+
+// msgpackCodec encodes messages as MessagePack binary frames, using the same field names as JSON.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string   { return EncodingMsgpack }
+func (msgpackCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := msgpack.NewEncoder(&buf).UseJSONTag(true).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(b []byte, v interface{}) error {
+	return msgpack.NewDecoder(bytes.NewReader(b)).UseJSONTag(true).Decode(v)
+}
+
+// codecs contains the supported codecs by encoding name.
+var codecs = map[string]Codec{
+	EncodingJSON:    jsonCodec{},
+	EncodingMsgpack: msgpackCodec{},
+}
+
+// defaultCodec is used until a client selects another encoding.
+var defaultCodec Codec = jsonCodec{}
+
+// supportedEncodings lists the encoding names clients may select, default first.
+var supportedEncodings = []string{EncodingJSON, EncodingMsgpack}
+
+// subprotocols lists the websocket subprotocols clients may request, in server preference order.
+var subprotocols = []string{SubprotocolPrefix + EncodingMsgpack, SubprotocolPrefix + EncodingJSON}
+
+func init() {
+	// Send ObjectIDs as hex strings, as they are in JSON
+	msgpack.Register(primitive.ObjectID{},
+		func(e *msgpack.Encoder, v reflect.Value) error {
+			return e.EncodeString(v.Interface().(primitive.ObjectID).Hex())
+		},
+		func(d *msgpack.Decoder, v reflect.Value) error {
+			s, err := d.DecodeString()
+			if err != nil {
+				return err
+			}
+			id, err := primitive.ObjectIDFromHex(s)
+			if err != nil {
+				return err
+			}
+			v.Set(reflect.ValueOf(id))
+			return nil
+		})
+}
+
+// getCodec returns the codec for an encoding name.
+func getCodec(encoding string) (Codec, error) {
+	codec, ok := codecs[encoding]
+	if !ok {
+		return nil, fmt.Errorf("encoding \"%s\" not supported", encoding)
+	}
+	return codec, nil
+}
+
+// codecForSubprotocol returns the codec for a negotiated websocket subprotocol, or the default codec if there is none.
+func codecForSubprotocol(subprotocol string) Codec {
+	if strings.HasPrefix(subprotocol, SubprotocolPrefix) {
+		if codec, err := getCodec(strings.TrimPrefix(subprotocol, SubprotocolPrefix)); err == nil {
+			return codec
+		}
+	}
+	return defaultCodec
+}
+
+// codecForFrame returns the codec to decode a received websocket message with, based on its frame type.
+func codecForFrame(frameType int) Codec {
+	if frameType == websocket.BinaryMessage {
+		return codecs[EncodingMsgpack]
+	}
+	return codecs[EncodingJSON]
+}
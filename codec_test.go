@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	id := primitive.NewObjectID()
+	for _, codec := range codecs {
+		t.Run(codec.Name(), func(t *testing.T) {
+			b, err := codec.Marshal(&EnterRoomResponse{Response: Response{ID: "1"}, RoomDoc: &RoomDoc{ID: id, RoomName: "room"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The envelope decodes on its own, as dispatch does before the full message
+			env := &Envelope{}
+			if err := codec.Unmarshal(b, env); err != nil || env.ID != "1" {
+				t.Errorf("got envelope %+v (%v), want ID 1", env, err)
+			}
+			res := &EnterRoomResponse{}
+			if err := codec.Unmarshal(b, res); err != nil {
+				t.Fatal(err)
+			}
+			if res.RoomDoc == nil || res.RoomDoc.ID != id || res.RoomDoc.RoomName != "room" {
+				t.Errorf("got room %+v, want %s", res.RoomDoc, id.Hex())
+			}
+		})
+	}
+}
+
+func TestCodecSelection(t *testing.T) {
+	if codec := codecForSubprotocol(SubprotocolPrefix + EncodingMsgpack); codec.Name() != EncodingMsgpack {
+		t.Errorf("got %s for the msgpack subprotocol", codec.Name())
+	}
+	if codec := codecForSubprotocol(""); codec != defaultCodec {
+		t.Errorf("got %s without a subprotocol, want the default", codec.Name())
+	}
+	if codec := codecForFrame(websocket.BinaryMessage); codec.Name() != EncodingMsgpack {
+		t.Errorf("got %s for binary frames", codec.Name())
+	}
+
+	// Announcing an encoding switches to it, ignoring unsupported ones
+	defer func(v TokenVerifier) { verifier = v }(verifier)
+	verifier = localVerifier{}
+	users = NewUserIndex()
+	c := newTestClient("")
+	res, _ := AnnounceHandler(c, &AnnounceMessage{ProtocolVersion: ProtocolVersion, IDToken: "alice", Encoding: EncodingMsgpack})
+	if res.Encoding != EncodingMsgpack || c.Codec().Name() != EncodingMsgpack {
+		t.Errorf("got encoding %s, want %s", res.Encoding, EncodingMsgpack)
+	}
+	res, _ = AnnounceHandler(c, &AnnounceMessage{ProtocolVersion: ProtocolVersion, IDToken: "alice", Encoding: "xml"})
+	if res.Encoding != EncodingMsgpack {
+		t.Errorf("got encoding %s after an unsupported one, want %s", res.Encoding, EncodingMsgpack)
+	}
+}
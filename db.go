@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -19,19 +19,22 @@ const (
 	DBTimeoutConnect = 10
 	DBTimeoutOp      = 2
 	MaxOpsPerBucket  = 100
+	MaxBucketBytes   = 8 << 20 // Well under mongo's 16MB document limit
 )
 
-// database is the common reference to mongo
-var database *DB
-
-// DB is a wrapper around a mongodb client.
+// DB is a wrapper around a mongodb client, and is the mongo implementation of Store.
 type DB struct {
 	client              *mongo.Client
 	db                  *mongo.Database
 	roomCol             *mongo.Collection
 	operationBucketsCol *mongo.Collection
+	archiveCol          *mongo.Collection
+	snapshotCol         *mongo.Collection
+	snapshotChunkCol    *mongo.Collection
+	opIDCol             *mongo.Collection
 	maxOpsPerBucket     int
-	writeMutex          sync.Mutex
+	maxBucketBytes      int
+	roomLocks           *KeyedMutex
 }
 
 // RoomDoc is a document that stores metadata about a room.
@@ -40,6 +43,7 @@ type RoomDoc struct {
 	RoomName   string             `bson:"room_name"`
 	NumBuckets int                `bson:"num_buckets"`
 	NumMembers int                `bson:"num_members"`
+	LastSeq    int64              `bson:"last_seq"`
 }
 
 // OpBucketDoc is a document that stores operations.
@@ -48,17 +52,20 @@ type OpBucketDoc struct {
 	RoomName string             `bson:"room_name"`
 	Bucket   int                `bson:"bucket"`
 	Count    int                `bson:"count"`
+	Bytes    int                `bson:"bytes"`
 	Ops      []bson.M           `bson:"operations"`
 }
 
 // NewDB creates a connection to the mongodb.
 func NewDB(uri string) *DB {
-	ctx, _ := context.WithTimeout(context.Background(), DBTimeoutConnect*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), DBTimeoutConnect*time.Second)
+	defer cancel()
 	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
 	if err != nil {
 		log.Fatalf("DB connect error: %s", err)
 	}
-	ctx, _ = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
 	err = client.Ping(ctx, readpref.Primary())
 	if err != nil {
 		log.Fatalf("DB ping error: %s", err)
@@ -71,13 +78,28 @@ func NewDB(uri string) *DB {
 	// Adapted hybrid comments pattern: https://docs.mongodb.com/drivers/use-cases/storing-comments
 	roomCol := db.Collection("room")
 	operationBucketsCol := db.Collection("operationBuckets")
+	archiveCol := db.Collection("operationBucketsArchive")
+	snapshotCol := db.Collection("snapshots")
+	snapshotChunkCol := db.Collection("snapshotChunks")
+	opIDCol := db.Collection("operationIds")
 
 	dbObj := &DB{
 		client:              client,
 		db:                  db,
 		roomCol:             roomCol,
 		operationBucketsCol: operationBucketsCol,
+		archiveCol:          archiveCol,
+		snapshotCol:         snapshotCol,
+		snapshotChunkCol:    snapshotChunkCol,
+		opIDCol:             opIDCol,
 		maxOpsPerBucket:     MaxOpsPerBucket,
+		maxBucketBytes:      MaxBucketBytes,
+		roomLocks:           NewKeyedMutex(),
+	}
+
+	// Batches are committed in transactions, so a batch and its operation IDs are written together or not at all
+	if !dbObj.supportsTransactions() {
+		log.Fatalf("mongo deployment must be a replica set or sharded cluster to commit operations in transactions")
 	}
 
 	// Ensure indicies
@@ -85,19 +107,44 @@ func NewDB(uri string) *DB {
 	return dbObj
 }
 
+// supportsTransactions returns whether the deployment is a replica set or sharded cluster, which support transactions.
+func (db *DB) supportsTransactions() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
+	var res bson.M
+	err := db.db.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&res)
+	if err != nil {
+		log.Warnf("unable to determine mongo deployment type: %s", err)
+		return false
+	}
+	_, replicaSet := res["setName"]
+	return replicaSet || res["msg"] == "isdbgrid"
+}
+
 // configureIndices ensure the DB has the necessary indices created.
 func (db *DB) configureIndices() {
 	// Index names to ensure exist
 	roomNameIndexName := "room_name"
 	opBucketIndexName := "room_name_bucket"
+	snapshotIndexName := "snapshot_room_name"
+	snapshotChunkIndexName := "snapshot_chunk_room_name_version_index"
+	archiveIndexName := "archive_room_name_bucket"
+	opIDIndexName := "op_id_room_name_op_id"
+	opIDExpiryIndexName := "op_id_expires_at"
 	expectedIndices := map[string]bool{
-		roomNameIndexName: false,
-		opBucketIndexName: false,
+		roomNameIndexName:      false,
+		opBucketIndexName:      false,
+		snapshotIndexName:      false,
+		snapshotChunkIndexName: false,
+		archiveIndexName:       false,
+		opIDIndexName:          false,
+		opIDExpiryIndexName:    false,
 	}
 
 	// List indices - ROOM
 	opts := options.ListIndexes().SetMaxTime(DBTimeoutOp * time.Second)
-	ctx, _ := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
 	cursor, err := db.roomCol.Indexes().List(ctx, opts)
 	if err != nil {
 		log.Fatalf("DB index list error: %s", err)
@@ -119,7 +166,8 @@ func (db *DB) configureIndices() {
 
 	// List indices - OP BUCKETS
 	opts = options.ListIndexes().SetMaxTime(DBTimeoutOp * time.Second)
-	ctx, _ = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
 	cursor, err = db.operationBucketsCol.Indexes().List(ctx, opts)
 	if err != nil {
 		log.Fatalf("DB index list error: %s", err)
@@ -139,6 +187,98 @@ func (db *DB) configureIndices() {
 		}
 	}
 
+	// List indices - SNAPSHOTS
+	opts = options.ListIndexes().SetMaxTime(DBTimeoutOp * time.Second)
+	ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
+	cursor, err = db.snapshotCol.Indexes().List(ctx, opts)
+	if err != nil {
+		log.Fatalf("DB index list error: %s", err)
+	}
+	var snapshotIndRes []bson.M
+	if err = cursor.All(context.Background(), &snapshotIndRes); err != nil {
+		log.Fatalf("DB index list cursor error: %s", err)
+	}
+
+	// Check if known indices are created
+	for _, ind := range snapshotIndRes {
+		name := ind["name"].(string)
+		log.Infof("existing index: %+v", ind)
+		_, ok := expectedIndices[name]
+		if ok {
+			expectedIndices[name] = true
+		}
+	}
+
+	// List indices - SNAPSHOT CHUNKS
+	opts = options.ListIndexes().SetMaxTime(DBTimeoutOp * time.Second)
+	ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
+	cursor, err = db.snapshotChunkCol.Indexes().List(ctx, opts)
+	if err != nil {
+		log.Fatalf("DB index list error: %s", err)
+	}
+	var snapshotChunkIndRes []bson.M
+	if err = cursor.All(context.Background(), &snapshotChunkIndRes); err != nil {
+		log.Fatalf("DB index list cursor error: %s", err)
+	}
+
+	// Check if known indices are created
+	for _, ind := range snapshotChunkIndRes {
+		name := ind["name"].(string)
+		log.Infof("existing index: %+v", ind)
+		_, ok := expectedIndices[name]
+		if ok {
+			expectedIndices[name] = true
+		}
+	}
+
+	// List indices - ARCHIVE
+	opts = options.ListIndexes().SetMaxTime(DBTimeoutOp * time.Second)
+	ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
+	cursor, err = db.archiveCol.Indexes().List(ctx, opts)
+	if err != nil {
+		log.Fatalf("DB index list error: %s", err)
+	}
+	var archiveIndRes []bson.M
+	if err = cursor.All(context.Background(), &archiveIndRes); err != nil {
+		log.Fatalf("DB index list cursor error: %s", err)
+	}
+
+	// Check if known indices are created
+	for _, ind := range archiveIndRes {
+		name := ind["name"].(string)
+		log.Infof("existing index: %+v", ind)
+		_, ok := expectedIndices[name]
+		if ok {
+			expectedIndices[name] = true
+		}
+	}
+
+	// List indices - OP IDS
+	opts = options.ListIndexes().SetMaxTime(DBTimeoutOp * time.Second)
+	ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
+	cursor, err = db.opIDCol.Indexes().List(ctx, opts)
+	if err != nil {
+		log.Fatalf("DB index list error: %s", err)
+	}
+	var opIDIndRes []bson.M
+	if err = cursor.All(context.Background(), &opIDIndRes); err != nil {
+		log.Fatalf("DB index list cursor error: %s", err)
+	}
+
+	// Check if known indices are created
+	for _, ind := range opIDIndRes {
+		name := ind["name"].(string)
+		log.Infof("existing index: %+v", ind)
+		_, ok := expectedIndices[name]
+		if ok {
+			expectedIndices[name] = true
+		}
+	}
+
 	// Create indices that don't yet exist
 	for indexName, created := range expectedIndices {
 		if !created {
@@ -150,7 +290,8 @@ func (db *DB) configureIndices() {
 					},
 					Options: options.Index().SetName(roomNameIndexName),
 				}
-				ctx, _ = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+				ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+				defer cancel()
 				_, err = db.roomCol.Indexes().CreateOne(ctx, roomIdxModel)
 				if err != nil {
 					log.Fatalf("unable to ensure room index: %s", err)
@@ -164,12 +305,88 @@ func (db *DB) configureIndices() {
 					},
 					Options: options.Index().SetName(opBucketIndexName),
 				}
-				ctx, _ = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+				ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+				defer cancel()
 				_, err = db.operationBucketsCol.Indexes().CreateOne(ctx, operationBucketsIdxModel)
 				if err != nil {
 					log.Fatalf("unable to ensure op bucket index: %s", err)
 				}
 				break
+			case snapshotIndexName:
+				snapshotIdxModel := mongo.IndexModel{
+					Keys: bson.M{
+						"room_name": 1,
+					},
+					Options: options.Index().SetName(snapshotIndexName).SetUnique(true),
+				}
+				ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+				defer cancel()
+				_, err = db.snapshotCol.Indexes().CreateOne(ctx, snapshotIdxModel)
+				if err != nil {
+					log.Fatalf("unable to ensure snapshot index: %s", err)
+				}
+				break
+			case snapshotChunkIndexName:
+				snapshotChunkIdxModel := mongo.IndexModel{
+					Keys: bson.D{
+						{Key: "room_name", Value: 1},
+						{Key: "version", Value: 1},
+						{Key: "index", Value: 1},
+					},
+					Options: options.Index().SetName(snapshotChunkIndexName),
+				}
+				ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+				defer cancel()
+				_, err = db.snapshotChunkCol.Indexes().CreateOne(ctx, snapshotChunkIdxModel)
+				if err != nil {
+					log.Fatalf("unable to ensure snapshot chunk index: %s", err)
+				}
+				break
+			case archiveIndexName:
+				archiveIdxModel := mongo.IndexModel{
+					Keys: bson.D{
+						{Key: "room_name", Value: 1},
+						{Key: "bucket", Value: 1},
+					},
+					Options: options.Index().SetName(archiveIndexName),
+				}
+				ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+				defer cancel()
+				_, err = db.archiveCol.Indexes().CreateOne(ctx, archiveIdxModel)
+				if err != nil {
+					log.Fatalf("unable to ensure archive index: %s", err)
+				}
+				break
+			case opIDIndexName:
+				opIDIdxModel := mongo.IndexModel{
+					Keys: bson.D{
+						{Key: "room_name", Value: 1},
+						{Key: "op_id", Value: 1},
+					},
+					Options: options.Index().SetName(opIDIndexName).SetUnique(true),
+				}
+				ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+				defer cancel()
+				_, err = db.opIDCol.Indexes().CreateOne(ctx, opIDIdxModel)
+				if err != nil {
+					log.Fatalf("unable to ensure op ID index: %s", err)
+				}
+				break
+			case opIDExpiryIndexName:
+				// Each document expires at its own expires_at
+				opIDExpiryIdxModel := mongo.IndexModel{
+					Keys: bson.M{
+						"expires_at": 1,
+					},
+					Options: options.Index().SetName(opIDExpiryIndexName).SetExpireAfterSeconds(0),
+				}
+				ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+				defer cancel()
+				_, err = db.opIDCol.Indexes().CreateOne(ctx, opIDExpiryIdxModel)
+				if err != nil {
+					log.Fatalf("unable to ensure op ID expiry index: %s", err)
+				}
+				break
 			}
 			log.Infof("created index %s", indexName)
 		}
@@ -178,7 +395,8 @@ func (db *DB) configureIndices() {
 
 // GetRoom gets the room document given a human-readable roomName.
 func (db *DB) GetRoom(roomName string) (*RoomDoc, error) {
-	ctx, _ := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
 	query := bson.M{"room_name": roomName}
 
 	room := &RoomDoc{}
@@ -186,14 +404,17 @@ func (db *DB) GetRoom(roomName string) (*RoomDoc, error) {
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			// Look up room in firestore
-			roomDoc, err := fb.GetRoom(roomName)
-			if err != nil {
-				return nil, err
+			if roomSource != nil {
+				roomDoc, err := roomSource.GetRoom(roomName)
+				if err != nil {
+					return nil, err
+				}
+				log.Debugf("creating room from firebase: %s", roomDoc)
 			}
 
 			// Create room in mongo
-			log.Debugf("creating room from firebase: %s", roomDoc)
-			ctx, _ := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+			ctx, cancel := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+			defer cancel()
 			room = &RoomDoc{
 				ID:         primitive.NewObjectID(),
 				RoomName:   roomName,
@@ -202,19 +423,20 @@ func (db *DB) GetRoom(roomName string) (*RoomDoc, error) {
 			}
 			res, err := db.roomCol.InsertOne(ctx, room)
 			if err != nil {
-				return nil, fmt.Errorf("database insert error: %s", err)
+				return nil, fmt.Errorf("database insert error: %w", err)
 			}
 			room.ID = res.InsertedID.(primitive.ObjectID)
 			return room, nil
 		}
-		return nil, fmt.Errorf("database find error: %s", err)
+		return nil, fmt.Errorf("database find error: %w", err)
 	}
 	return room, nil
 }
 
 // UpdateRoomNumMembers increments/decrements the number of members in a room.
 func (db *DB) UpdateRoomNumMembers(roomName string, updateIncrement int) (*RoomDoc, error) {
-	ctx, _ := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
 	query := bson.M{"room_name": roomName}
 	operation := bson.M{"$inc": bson.M{"num_members": updateIncrement}}
 	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
@@ -222,74 +444,337 @@ func (db *DB) UpdateRoomNumMembers(roomName string, updateIncrement int) (*RoomD
 	roomDoc := &RoomDoc{}
 	err := db.roomCol.FindOneAndUpdate(ctx, query, operation, opts).Decode(roomDoc)
 	if err != nil {
-		return nil, fmt.Errorf("database update room num_members error: %s", err)
+		return nil, fmt.Errorf("database update room num_members error: %w", err)
 	}
 	return roomDoc, nil
 }
 
-// commitOperation stores an operation committed in a room.
-func (db *DB) commitOperation(roomDoc *RoomDoc, op bson.M) (*OpBucketDoc, error) {
-	ctx, _ := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
-	query := bson.M{"room_name": roomDoc.RoomName, "bucket": roomDoc.NumBuckets}
-	operation := bson.M{"$inc": bson.M{"count": 1}, "$push": bson.M{"operations": op}}
-	opts := options.FindOneAndUpdate().SetReturnDocument(options.After).SetUpsert(true)
+// MaxCommitAttempts is how many times a batch is planned and written when other writers commit to the room first.
+const MaxCommitAttempts = 5
+
+// errBatchConflict is returned when another writer committed to a room after a batch was planned.
+var errBatchConflict = errors.New("room changed while committing")
+
+// getBucketSize returns the number of operations in a bucket and their size in bytes, or 0 if it doesn't exist yet.
+func (db *DB) getBucketSize(ctx context.Context, roomName string, bucket int) (int, int, error) {
+	query := bson.M{"room_name": roomName, "bucket": bucket}
+	opts := options.FindOne().SetProjection(bson.M{"count": 1, "bytes": 1})
+
+	var bucketDoc struct {
+		Count int `bson:"count"`
+		Bytes int `bson:"bytes"`
+	}
+	err := db.operationBucketsCol.FindOne(ctx, query, opts).Decode(&bucketDoc)
+	if err == mongo.ErrNoDocuments {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("database find error: %w", err)
+	}
+	return bucketDoc.Count, bucketDoc.Bytes, nil
+}
+
+// planCommit reads the room and its current bucket, and plans writing a batch of operations after them.
+// Returns the room as read, the chunks, and the room's last sequence number and number of buckets after the batch.
+func (db *DB) planCommit(ctx context.Context, roomName string, ops []bson.M) (*RoomDoc, []bucketChunk, int64, int, error) {
+	room := &RoomDoc{}
+	err := db.roomCol.FindOne(ctx, bson.M{"room_name": roomName}).Decode(room)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil, 0, 0, fmt.Errorf("%w: %s", ErrRoomNotFound, roomName)
+	}
+	if err != nil {
+		return nil, nil, 0, 0, fmt.Errorf("database find error: %w", err)
+	}
+	bucketCount, bucketBytes, err := db.getBucketSize(ctx, roomName, room.NumBuckets)
+	if err != nil {
+		return nil, nil, 0, 0, fmt.Errorf("unable to get current bucket: %w", err)
+	}
+	chunks, lastSeq, numBuckets := planBatch(room, bucketCount, bucketBytes, ops, db.maxOpsPerBucket, db.maxBucketBytes)
+	return room, chunks, lastSeq, numBuckets, nil
+}
 
-	opBucket := &OpBucketDoc{}
-	err := db.operationBucketsCol.FindOneAndUpdate(ctx, query, operation, opts).Decode(opBucket)
+// claimBatch records the room's new last sequence number and number of buckets, if they are still as planned from.
+// Fails with errBatchConflict if another writer committed to the room since it was read.
+func (db *DB) claimBatch(ctx context.Context, room *RoomDoc, lastSeq int64, numBuckets int) error {
+	// Rooms created before sequence numbers have no last_seq
+	var plannedSeq interface{} = room.LastSeq
+	if room.LastSeq == 0 {
+		plannedSeq = bson.M{"$in": bson.A{0, nil}}
+	}
+	query := bson.M{"_id": room.ID, "last_seq": plannedSeq, "num_buckets": room.NumBuckets}
+	update := bson.M{"$set": bson.M{"last_seq": lastSeq, "num_buckets": numBuckets}}
+	res, err := db.roomCol.UpdateOne(ctx, query, update)
 	if err != nil {
-		return nil, fmt.Errorf("database update op bucket with op error: %s", err)
+		return fmt.Errorf("database update room last_seq and num_buckets error: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return errBatchConflict
 	}
+	return nil
+}
 
-	if opBucket.Count == db.maxOpsPerBucket {
-		ctx, _ := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
-		query := bson.M{"_id": roomDoc.ID, "num_buckets": roomDoc.NumBuckets}
-		update := bson.M{"$inc": bson.M{"num_buckets": 1}}
+// writeChunks writes the chunks of a batch of operations to their buckets.
+func (db *DB) writeChunks(ctx context.Context, roomName string, chunks []bucketChunk) error {
+	for _, chunk := range chunks {
+		query := bson.M{"room_name": roomName, "bucket": chunk.Bucket}
+		operation := bson.M{
+			"$inc":  bson.M{"count": len(chunk.Ops), "bytes": chunk.Bytes},
+			"$push": bson.M{"operations": bson.M{"$each": chunk.Ops}},
+		}
+		opts := options.Update().SetUpsert(true)
 
-		_, err = db.roomCol.UpdateOne(ctx, query, update)
+		_, err := db.operationBucketsCol.UpdateOne(ctx, query, operation, opts)
 		if err != nil {
-			return nil, fmt.Errorf("database update num op buckets error: %s", err)
+			return fmt.Errorf("database update op bucket with ops error: %w", err)
+		}
+	}
+	return nil
+}
+
+// commitBatch dedupes, plans and writes a batch of operations committed in a room in a transaction, remembering
+// their IDs for the dedupe window. Returns the results and the operations committed, as dedupeOperations.
+// The room and the committed IDs are read within the transaction, so a retried transaction plans from them as they
+// are then. Fails with errBatchConflict if another writer committed to the room after it was read.
+func (db *DB) commitBatch(roomName string, ops []bson.M) ([]bson.M, []bson.M, error) {
+	// Allow each write its own timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(len(ops)/db.maxOpsPerBucket+5)*DBTimeoutOp*time.Second)
+	defer cancel()
+	var results, fresh []bson.M
+	err := db.client.UseSession(ctx, func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+			// Skip operations already committed within the dedupe window
+			committed, err := db.getCommittedOperations(sc, roomName, opIDs(ops))
+			if err != nil {
+				return nil, fmt.Errorf("unable to get committed operation IDs: %w", err)
+			}
+			results, fresh = dedupeOperations(ops, committed)
+			if len(fresh) == 0 {
+				return nil, nil
+			}
+
+			room, chunks, lastSeq, numBuckets, err := db.planCommit(sc, roomName, fresh)
+			if err != nil {
+				return nil, err
+			}
+			err = db.claimBatch(sc, room, lastSeq, numBuckets)
+			if err != nil {
+				return nil, err
+			}
+			err = db.writeChunks(sc, roomName, chunks)
+			if err != nil {
+				return nil, err
+			}
+			return nil, db.rememberOperations(sc, roomName, fresh)
+		})
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return results, fresh, nil
+}
+
+// CommitOperations writes operations committed in a room, stamping each with its sequence number.
+// All operations submitted together are written together or not at all.
+func (db *DB) CommitOperations(roomName string, ops []bson.M) ([]bson.M, []bson.M, error) {
+	// Hand out sequence numbers and buckets in commit order within a room without conflicts between this server's
+	// 	writers, while other rooms commit in parallel. Other servers are caught by claiming the batch.
+	unlock := db.roomLocks.Lock(roomName)
+	defer unlock()
+
+	// Create the room if it doesn't exist yet
+	_, err := db.GetRoom(roomName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get room: %w", err)
+	}
+
+	for attempt := 1; ; attempt++ {
+		results, fresh, err := db.commitBatch(roomName, ops)
+		if err == nil {
+			return results, fresh, nil
+		}
+		if !errors.Is(err, errBatchConflict) || attempt == MaxCommitAttempts {
+			return nil, nil, fmt.Errorf("unable to commit operations: %w", err)
 		}
+		log.Warnf("room %s changed while committing, replanning (attempt %d)", roomName, attempt)
 	}
+}
 
-	return opBucket, nil
+// LockRoom locks a room against commits, rebalances and other holders of the lock on this server, returning the
+// function to unlock it.
+func (db *DB) LockRoom(roomName string) func() {
+	return db.roomLocks.Lock(roomName)
 }
 
-// CommitOperations writes operations committed in a room.
-func (db *DB) CommitOperations(roomName string, ops []bson.M) ([]bson.M, error) {
+// RebalanceOperations splits a room's buckets that are over the count or byte limits, renumbering the buckets after
+// them and the room's snapshot watermark.
+func (db *DB) RebalanceOperations(roomName string) (*RebalanceResult, error) {
+	unlock := db.roomLocks.Lock(roomName)
+	defer unlock()
+
 	room, err := db.GetRoom(roomName)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get room: %w", err)
 	}
+	buckets, err := db.GetOperationBuckets(roomName, 1, room.NumBuckets)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := db.GetSnapshot(roomName)
+	if err != nil {
+		return nil, err
+	}
+	rebalanced, shifts := rebalanceBuckets(buckets, db.maxOpsPerBucket, db.maxBucketBytes)
+	numBuckets := shiftBucket(room.NumBuckets, shifts)
+	result := &RebalanceResult{
+		RoomName:      roomName,
+		BucketsBefore: len(buckets),
+		BucketsAfter:  len(rebalanced),
+		BucketsSplit:  countSplitBuckets(shifts),
+	}
 
-	// Ensure all operations submitted together are written together
-	db.writeMutex.Lock()
-	defer db.writeMutex.Unlock()
-
-	// Commit all operations
-	for _, op := range ops {
-		_, err := db.commitOperation(room, op)
+	// Insert the rebalanced buckets before deleting the old ones, so a failure part way never loses operations
+	write := func(ctx context.Context) error {
+		if len(rebalanced) > 0 {
+			docs := make([]interface{}, len(rebalanced))
+			for i, bucketDoc := range rebalanced {
+				docs[i] = bucketDoc
+			}
+			_, err := db.operationBucketsCol.InsertMany(ctx, docs)
+			if err != nil {
+				return fmt.Errorf("database insert rebalanced buckets error: %w", err)
+			}
+		}
+		ids := make([]primitive.ObjectID, len(buckets))
+		for i, bucketDoc := range buckets {
+			ids[i] = bucketDoc.ID
+		}
+		_, err := db.operationBucketsCol.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return fmt.Errorf("database delete old buckets error: %w", err)
+		}
+		_, err = db.roomCol.UpdateOne(ctx, bson.M{"_id": room.ID}, bson.M{"$set": bson.M{"num_buckets": numBuckets}})
 		if err != nil {
-			return nil, fmt.Errorf("unable to commit operation: %w", err)
+			return fmt.Errorf("database update room num_buckets error: %w", err)
 		}
+		if snapshot != nil {
+			query := bson.M{"room_name": roomName}
+			update := bson.M{"$set": bson.M{"bucket": shiftBucket(snapshot.Bucket, shifts)}}
+			_, err = db.snapshotCol.UpdateOne(ctx, query, update)
+			if err != nil {
+				return fmt.Errorf("database update snapshot bucket error: %w", err)
+			}
+		}
+		return nil
 	}
 
-	return ops, nil
+	ctx, cancel := context.WithTimeout(context.Background(), 4*DBTimeoutOp*time.Second)
+	defer cancel()
+	err = db.client.UseSession(ctx, func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+			return nil, write(sc)
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to rebalance buckets: %w", err)
+	}
+	return result, nil
+}
+
+// GetCommittedOperations returns the operations committed in a room within the dedupe window, by ID.
+func (db *DB) GetCommittedOperations(roomName string, ids []string) (map[string]bson.M, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*DBTimeoutOp*time.Second)
+	defer cancel()
+	return db.getCommittedOperations(ctx, roomName, ids)
+}
+
+// getCommittedOperations returns the operations committed in a room within the dedupe window, by ID.
+func (db *DB) getCommittedOperations(ctx context.Context, roomName string, ids []string) (map[string]bson.M, error) {
+	committed := make(map[string]bson.M)
+	if len(ids) == 0 {
+		return committed, nil
+	}
+
+	// Expired documents are only deleted periodically, so filter them out
+	query := bson.M{"room_name": roomName, "op_id": bson.M{"$in": ids}, "expires_at": bson.M{"$gt": time.Now()}}
+	cursor, err := db.opIDCol.Find(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("database find error: %w", err)
+	}
+	var results []OpIDDoc
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, fmt.Errorf("database find cursor error: %w", err)
+	}
+	for _, doc := range results {
+		committed[doc.OpID] = doc.Operation
+	}
+	return committed, nil
+}
+
+// rememberOperations records the IDs of operations committed in a room for the dedupe window.
+// Fails with errBatchConflict if another writer committed an operation with one of the IDs within the window.
+func (db *DB) rememberOperations(ctx context.Context, roomName string, ops []bson.M) error {
+	docs := NewOpIDDocs(roomName, ops)
+	if len(docs) == 0 {
+		return nil
+	}
+
+	// Replace IDs remembered from before the window, which may not have been deleted yet.
+	// IDs still within it don't match, so the upsert inserts a duplicate key.
+	models := []mongo.WriteModel{}
+	now := time.Now()
+	for _, doc := range docs {
+		query := bson.M{"room_name": roomName, "op_id": doc.OpID, "expires_at": bson.M{"$lte": now}}
+		models = append(models, mongo.NewReplaceOneModel().SetFilter(query).SetReplacement(doc).SetUpsert(true))
+	}
+	_, err := db.opIDCol.BulkWrite(ctx, models)
+	if isDuplicateKeyError(err) {
+		return fmt.Errorf("%w: operation IDs committed by another writer", errBatchConflict)
+	}
+	if err != nil {
+		return fmt.Errorf("database write op IDs error: %w", err)
+	}
+	return nil
+}
+
+// isDuplicateKeyError returns whether a write failed on a unique index.
+func isDuplicateKeyError(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) {
+		for _, writeErr := range bulkErr.WriteErrors {
+			if writeErr.Code == 11000 {
+				return true
+			}
+		}
+	}
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) {
+		for _, e := range writeErr.WriteErrors {
+			if e.Code == 11000 {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // GetAllOperations returns the full history of operations for a given room.
 func (db *DB) GetAllOperations(roomName string) ([]bson.M, error) {
 	all := []bson.M{}
-	ctx, _ := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
 	query := bson.M{"room_name": roomName}
 
 	cursor, err := db.operationBucketsCol.Find(ctx, query)
 	if err != nil {
-		return nil, fmt.Errorf("database find error: %s", err)
+		return nil, fmt.Errorf("database find error: %w", err)
 	}
 	var results []OpBucketDoc
-	ctx, _ = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
 	if err = cursor.All(ctx, &results); err != nil {
-		return nil, fmt.Errorf("database find cursor error: %s", err)
+		return nil, fmt.Errorf("database find cursor error: %w", err)
 	}
 	for _, bucketDoc := range results {
 		all = append(all, bucketDoc.Ops...)
@@ -297,19 +782,298 @@ func (db *DB) GetAllOperations(roomName string) ([]bson.M, error) {
 	return all, nil
 }
 
-// DeleteAllOperations deletes all operations for a given room.
+// GetOperationsSince returns the operations for a given room with a sequence number greater than sinceSeq,
+// searching from sinceBucket onwards.
+func (db *DB) GetOperationsSince(roomName string, sinceSeq int64, sinceBucket int) ([]bson.M, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
+	query := bson.M{"room_name": roomName, "bucket": bson.M{"$gte": sinceBucket}}
+	opts := options.Find().SetSort(bson.D{{Key: "bucket", Value: 1}})
+
+	cursor, err := db.operationBucketsCol.Find(ctx, query, opts)
+	if err != nil {
+		return nil, fmt.Errorf("database find error: %w", err)
+	}
+	var results []OpBucketDoc
+	ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, fmt.Errorf("database find cursor error: %w", err)
+	}
+
+	ops := []bson.M{}
+	for _, bucketDoc := range results {
+		ops = append(ops, filterOperationsSince(bucketDoc.Ops, sinceSeq)...)
+	}
+	return ops, nil
+}
+
+// GetOperationBuckets returns the operation buckets for a given room from fromBucket to toBucket inclusive, in bucket order.
+func (db *DB) GetOperationBuckets(roomName string, fromBucket int, toBucket int) ([]OpBucketDoc, error) {
+	return db.getBuckets(db.operationBucketsCol, roomName, fromBucket, toBucket)
+}
+
+// GetArchivedOperationBuckets returns the archived operation buckets for a given room from fromBucket to toBucket
+// inclusive, in bucket order.
+func (db *DB) GetArchivedOperationBuckets(roomName string, fromBucket int, toBucket int) ([]OpBucketDoc, error) {
+	return db.getBuckets(db.archiveCol, roomName, fromBucket, toBucket)
+}
+
+// getBuckets returns the buckets in a collection for a given room from fromBucket to toBucket inclusive, in bucket order.
+func (db *DB) getBuckets(col *mongo.Collection, roomName string, fromBucket int, toBucket int) ([]OpBucketDoc, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
+	query := bson.M{"room_name": roomName, "bucket": bson.M{"$gte": fromBucket, "$lte": toBucket}}
+	opts := options.Find().SetSort(bson.D{{Key: "bucket", Value: 1}})
+
+	cursor, err := col.Find(ctx, query, opts)
+	if err != nil {
+		return nil, fmt.Errorf("database find error: %w", err)
+	}
+	results := []OpBucketDoc{}
+	ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, fmt.Errorf("database find cursor error: %w", err)
+	}
+	return results, nil
+}
+
+// GetSnapshot returns the latest snapshot for a given room, or nil if there is none.
+func (db *DB) GetSnapshot(roomName string) (*SnapshotDoc, error) {
+	// A snapshot saved while reading its chunks deletes them, so read the new one instead
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		var snapshot *SnapshotDoc
+		snapshot, err = db.getSnapshot(roomName)
+		if err == nil || !errors.Is(err, errSnapshotChanged) {
+			return snapshot, err
+		}
+	}
+	return nil, err
+}
+
+// errSnapshotChanged is returned when a snapshot's chunks were replaced while reading them.
+var errSnapshotChanged = errors.New("snapshot changed while reading it")
+
+// getSnapshot reads the snapshot for a given room and the chunks of its operations, or nil if there is none.
+func (db *DB) getSnapshot(roomName string) (*SnapshotDoc, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
+	query := bson.M{"room_name": roomName}
+
+	snapshot := &SnapshotDoc{}
+	err := db.snapshotCol.FindOne(ctx, query).Decode(snapshot)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("database find snapshot error: %w", err)
+	}
+	if snapshot.Chunks == 0 {
+		return snapshot, nil
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
+	query = bson.M{"room_name": roomName, "version": snapshot.Version}
+	opts := options.Find().SetSort(bson.M{"index": 1})
+	cursor, err := db.snapshotChunkCol.Find(ctx, query, opts)
+	if err != nil {
+		return nil, fmt.Errorf("database find snapshot chunks error: %w", err)
+	}
+	var chunks []SnapshotChunkDoc
+	ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
+	if err = cursor.All(ctx, &chunks); err != nil {
+		return nil, fmt.Errorf("database find snapshot chunks cursor error: %w", err)
+	}
+	if len(chunks) != snapshot.Chunks {
+		return nil, fmt.Errorf("%w: found %d of %d chunks", errSnapshotChanged, len(chunks), snapshot.Chunks)
+	}
+
+	ops := []bson.M{}
+	for _, chunk := range chunks {
+		ops = append(ops, chunk.Ops...)
+	}
+	if snapshot.State == nil {
+		snapshot.State = bson.M{}
+	}
+	snapshot.State[StateKeyOperations] = ops
+	return snapshot, nil
+}
+
+// SaveSnapshot replaces the snapshot for the snapshot's room.
+// The state's operations are written to chunk documents of up to maxBucketBytes each, so a snapshot never hits the
+// document size limit. The snapshot points at the new chunks once they are all written, then the old chunks are
+// deleted.
+func (db *DB) SaveSnapshot(snapshot *SnapshotDoc) error {
+	stored := *snapshot
+	stored.Version = primitive.NewObjectID()
+	stored.State = bson.M{}
+	for k, v := range snapshot.State {
+		if k != StateKeyOperations {
+			stored.State[k] = v
+		}
+	}
+
+	chunks := splitSnapshotOperations(asOperations(snapshot.State[StateKeyOperations]), db.maxBucketBytes)
+	for i, ops := range chunks {
+		ctx, cancel := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+		_, err := db.snapshotChunkCol.InsertOne(ctx, SnapshotChunkDoc{
+			ID:       primitive.NewObjectID(),
+			RoomName: snapshot.RoomName,
+			Version:  stored.Version,
+			Index:    i,
+			Ops:      ops,
+		})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("database insert snapshot chunk error: %w", err)
+		}
+	}
+	stored.Chunks = len(chunks)
+
+	ctx, cancel := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
+	query := bson.M{"room_name": snapshot.RoomName}
+	opts := options.Replace().SetUpsert(true)
+	_, err := db.snapshotCol.ReplaceOne(ctx, query, stored, opts)
+	if err != nil {
+		return fmt.Errorf("database replace snapshot error: %w", err)
+	}
+
+	// Chunks of previous snapshots are no longer referenced, failing to delete them only wastes space
+	ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
+	query = bson.M{"room_name": snapshot.RoomName, "version": bson.M{"$ne": stored.Version}}
+	_, err = db.snapshotChunkCol.DeleteMany(ctx, query)
+	if err != nil {
+		log.Errorf("unable to delete old snapshot chunks of room %s: %s", snapshot.RoomName, err)
+	}
+	return nil
+}
+
+// ArchiveOperations moves the operation buckets for a given room up to throughBucket inclusive into the archive.
+// The room must be locked with LockRoom.
+func (db *DB) ArchiveOperations(roomName string, throughBucket int) error {
+	buckets, err := db.GetOperationBuckets(roomName, 1, throughBucket)
+	if err != nil {
+		return err
+	}
+
+	// Copy buckets first so a failure part way never loses operations
+	for _, bucketDoc := range buckets {
+		ctx, cancel := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+		query := bson.M{"_id": bucketDoc.ID}
+		opts := options.Replace().SetUpsert(true)
+		_, err := db.archiveCol.ReplaceOne(ctx, query, bucketDoc, opts)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("database archive bucket error: %w", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
+	query := bson.M{"room_name": roomName, "bucket": bson.M{"$lte": throughBucket}}
+
+	_, err = db.operationBucketsCol.DeleteMany(ctx, query)
+	if err != nil {
+		return fmt.Errorf("database delete many error: %w", err)
+	}
+	return nil
+}
+
+// ImportRoom creates a room with the given operation buckets, failing if the room already exists.
+func (db *DB) ImportRoom(room *RoomDoc, buckets []OpBucketDoc) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
+	query := bson.M{"room_name": room.RoomName}
+
+	count, err := db.roomCol.CountDocuments(ctx, query)
+	if err != nil {
+		return fmt.Errorf("database count error: %w", err)
+	}
+	if count > 0 {
+		return fmt.Errorf("room %s already exists", room.RoomName)
+	}
+
+	// Insert buckets before the room, so the room never exists without its operations
+	if len(buckets) > 0 {
+		docs := make([]interface{}, len(buckets))
+		for i, bucketDoc := range buckets {
+			docs[i] = bucketDoc
+		}
+		ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+		defer cancel()
+		_, err = db.operationBucketsCol.InsertMany(ctx, docs)
+		if err != nil {
+			return fmt.Errorf("database insert many error: %w", err)
+		}
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
+	_, err = db.roomCol.InsertOne(ctx, room)
+	if err != nil {
+		// Clean up the orphaned buckets
+		ctx, cancel := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+		defer cancel()
+		_, deleteErr := db.operationBucketsCol.DeleteMany(ctx, query)
+		if deleteErr != nil {
+			log.Errorf("[DATA OUT OF SYNC] unable to delete buckets for room %s after failed import: %s", room.RoomName, deleteErr)
+		}
+		return fmt.Errorf("database insert error: %w", err)
+	}
+	return nil
+}
+
+// DeleteAllOperations deletes all operations, archived operations, snapshots and operation IDs for a given room.
 func (db *DB) DeleteAllOperations(roomName string) error {
+	// Don't reset num_buckets under a batch being committed
+	unlock := db.roomLocks.Lock(roomName)
+	defer unlock()
+
 	// Delete all buckets
-	ctx, _ := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
 	query := bson.M{"room_name": roomName}
 
 	_, err := db.operationBucketsCol.DeleteMany(ctx, query)
 	if err != nil {
-		return fmt.Errorf("database delete many error: %s", err)
+		return fmt.Errorf("database delete many error: %w", err)
+	}
+
+	// Delete archived buckets, snapshot and operation IDs
+	ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
+	_, err = db.archiveCol.DeleteMany(ctx, query)
+	if err != nil {
+		return fmt.Errorf("database delete many archived error: %w", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
+	_, err = db.snapshotCol.DeleteOne(ctx, query)
+	if err != nil {
+		return fmt.Errorf("database delete snapshot error: %w", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
+	_, err = db.snapshotChunkCol.DeleteMany(ctx, query)
+	if err != nil {
+		return fmt.Errorf("database delete snapshot chunks error: %w", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
+	_, err = db.opIDCol.DeleteMany(ctx, query)
+	if err != nil {
+		return fmt.Errorf("database delete operation IDs error: %w", err)
 	}
 
 	// Set num_buckets to one
-	ctx, _ = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	ctx, cancel = context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
 	query = bson.M{"room_name": roomName}
 	operation := bson.M{"$set": bson.M{"num_buckets": 1}}
 	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
@@ -317,34 +1081,26 @@ func (db *DB) DeleteAllOperations(roomName string) error {
 	roomDoc := &RoomDoc{}
 	err = db.roomCol.FindOneAndUpdate(ctx, query, operation, opts).Decode(roomDoc)
 	if err != nil {
-		return fmt.Errorf("database update room num_buckets error: %s", err)
+		return fmt.Errorf("database update room num_buckets error: %w", err)
 	}
 	if roomDoc.NumBuckets != 1 {
 		return fmt.Errorf("num_buckets of room %s was not set to 1 after deleting all operations", roomName)
 	}
 
-	// Reset all clients
-	room, ok := rooms.Get(roomName)
-	if !ok {
-		return fmt.Errorf("server is not tracking room %s, but its operations have been deleted", roomName)
-	}
-	room.Broadcast(bson.M{
-		"type": TypeClearState,
-	})
-
 	return nil
 }
 
 // ResetNumMembers sets the numMembers to 0 for all rooms.
 func (db *DB) ResetNumMembers() error {
 	// Update all NumMembers to 0
-	ctx, _ := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), DBTimeoutOp*time.Second)
+	defer cancel()
 	filter := bson.M{}
 	update := bson.M{"$set": bson.M{"num_members": 0}}
 
 	updateResult, err := db.roomCol.UpdateMany(ctx, filter, update)
 	if err != nil {
-		return fmt.Errorf("database update many error: %s", err)
+		return fmt.Errorf("database update many error: %w", err)
 	}
 	log.Infof("reset NumMembers for %d (filter matched %d)", updateResult.ModifiedCount, updateResult.MatchedCount)
 
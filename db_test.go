@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestIsDuplicateKeyError(t *testing.T) {
+	bulkErr := func(code int) error {
+		return mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{{WriteError: mongo.WriteError{Code: code}}}}
+	}
+
+	tests := []struct {
+		name      string
+		err       error
+		duplicate bool
+	}{
+		{"nil", nil, false},
+		{"other error", errors.New("no reachable servers"), false},
+		{"bulk write", bulkErr(11000), true},
+		{"other bulk write error", bulkErr(121), false},
+		{"write", mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000}}}, true},
+		{"wrapped", fmt.Errorf("unable to commit: %w", bulkErr(11000)), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if duplicate := isDuplicateKeyError(test.err); duplicate != test.duplicate {
+				t.Errorf("got %t, want %t", duplicate, test.duplicate)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// OpKeyID is the client-supplied unique ID of an operation, used to deduplicate retried submissions.
+const OpKeyID = "uuid"
+
+// DefaultDedupeWindow is how long operation IDs are remembered per room.
+const DefaultDedupeWindow = 10 * time.Minute
+
+// dedupeWindow is configured with the DEDUPE_WINDOW env var (milliseconds), 0 disables deduplication.
+var dedupeWindow = DefaultDedupeWindow
+
+// loadDedupe configures how long operation IDs are remembered from the DEDUPE_WINDOW env var.
+func loadDedupe() {
+	dedupeWindow = envMillis("DEDUPE_WINDOW", DefaultDedupeWindow, 0)
+	log.Infof("operation dedupe window %s", dedupeWindow)
+}
+
+// OpIDDoc is a document that remembers the operation committed with a client-supplied ID.
+type OpIDDoc struct {
+	RoomName  string    `bson:"room_name"`
+	OpID      string    `bson:"op_id"`
+	Operation bson.M    `bson:"operation"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// NewOpIDDocs creates the documents remembering committed operations with client-supplied IDs until the dedupe
+// window passes.
+func NewOpIDDocs(roomName string, ops []bson.M) []OpIDDoc {
+	expiresAt := time.Now().Add(dedupeWindow)
+	docs := []OpIDDoc{}
+	for _, op := range ops {
+		if id := opID(op); id != "" {
+			docs = append(docs, OpIDDoc{
+				RoomName:  roomName,
+				OpID:      id,
+				Operation: op,
+				ExpiresAt: expiresAt,
+			})
+		}
+	}
+	return docs
+}
+
+// opID returns the client-supplied ID of an operation, or "" if it has none or deduplication is disabled.
+func opID(op bson.M) string {
+	if dedupeWindow <= 0 {
+		return ""
+	}
+	id, _ := op[OpKeyID].(string)
+	return id
+}
+
+// opIDs returns the client-supplied IDs of operations.
+func opIDs(ops []bson.M) []string {
+	ids := []string{}
+	for _, op := range ops {
+		if id := opID(op); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// dedupeOperations splits submitted operations into those not yet committed, and the results in submission order,
+// where already committed operations are replaced by the original from committed (by ID).
+// Operations repeated within the submission are only committed once.
+func dedupeOperations(ops []bson.M, committed map[string]bson.M) ([]bson.M, []bson.M) {
+	results := make([]bson.M, len(ops))
+	fresh := []bson.M{}
+	submitted := make(map[string]bson.M)
+	for i, op := range ops {
+		id := opID(op)
+		if original, ok := committed[id]; ok && id != "" {
+			results[i] = original
+			continue
+		}
+		if original, ok := submitted[id]; ok && id != "" {
+			results[i] = original // Stamped when the original is committed
+			continue
+		}
+		submitted[id] = op
+		results[i] = op
+		fresh = append(fresh, op)
+	}
+	return results, fresh
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestDedupeOperations(t *testing.T) {
+	op := func(id string, n int) bson.M {
+		op := bson.M{"type": "ADD_STEP", "n": n}
+		if id != "" {
+			op[OpKeyID] = id
+		}
+		return op
+	}
+	committed := map[string]bson.M{"a": op("a", 0)}
+
+	tests := []struct {
+		name    string
+		window  time.Duration
+		ops     []bson.M
+		fresh   []int // n of the operations to commit
+		results []int // n of the results in submission order
+	}{
+		{"none", DefaultDedupeWindow, []bson.M{}, []int{}, []int{}},
+		{"fresh", DefaultDedupeWindow, []bson.M{op("b", 1), op("c", 2)}, []int{1, 2}, []int{1, 2}},
+		{"committed", DefaultDedupeWindow, []bson.M{op("a", 1), op("b", 2)}, []int{2}, []int{0, 2}},
+		{"repeated in submission", DefaultDedupeWindow, []bson.M{op("b", 1), op("b", 2), op("c", 3)}, []int{1, 3}, []int{1, 1, 3}},
+		{"without IDs", DefaultDedupeWindow, []bson.M{op("", 1), op("", 2)}, []int{1, 2}, []int{1, 2}},
+		{"disabled", 0, []bson.M{op("a", 1), op("a", 2)}, []int{1, 2}, []int{1, 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer func(window time.Duration) { dedupeWindow = window }(dedupeWindow)
+			dedupeWindow = test.window
+
+			results, fresh := dedupeOperations(test.ops, committed)
+			if len(fresh) != len(test.fresh) {
+				t.Fatalf("got %d fresh operations, want %d", len(fresh), len(test.fresh))
+			}
+			for i, op := range fresh {
+				if op["n"] != test.fresh[i] {
+					t.Errorf("fresh operation %d is %v, want n %d", i, op, test.fresh[i])
+				}
+			}
+			if len(results) != len(test.results) {
+				t.Fatalf("got %d results, want %d", len(results), len(test.results))
+			}
+			for i, op := range results {
+				if op["n"] != test.results[i] {
+					t.Errorf("result %d is %v, want n %d", i, op, test.results[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCommitOperationsDedupe(t *testing.T) {
+	newSnapshotTestStore("room", "", 100)
+	defer func(window time.Duration) { dedupeWindow = window }(dedupeWindow)
+	dedupeWindow = DefaultDedupeWindow
+
+	first, _, err := database.CommitOperations("room", []bson.M{{"type": "ADD_STEP", OpKeyID: "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A retry of the batch returns the original, and only commits the new operation
+	results, fresh, err := database.CommitOperations("room", []bson.M{{"type": "ADD_STEP", OpKeyID: "a"}, {"type": "ADD_STEP", OpKeyID: "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fresh) != 1 || fresh[0][OpKeyID] != "b" {
+		t.Errorf("got fresh operations %v, want only b", fresh)
+	}
+	if opSeq(results[0]) != opSeq(first[0]) || opSeq(results[1]) != 2 {
+		t.Errorf("got seqs %d and %d, want %d and 2", opSeq(results[0]), opSeq(results[1]), opSeq(first[0]))
+	}
+	room, _ := database.GetRoom("room")
+	if room.LastSeq != 2 {
+		t.Errorf("got last seq %d, want 2", room.LastSeq)
+	}
+
+	// IDs are forgotten after the window
+	dedupeWindow = time.Nanosecond
+	database.CommitOperations("room", []bson.M{{"type": "ADD_STEP", OpKeyID: "c"}})
+	time.Sleep(time.Millisecond)
+	_, fresh, err = database.CommitOperations("room", []bson.M{{"type": "ADD_STEP", OpKeyID: "c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fresh) != 1 {
+		t.Errorf("got %d fresh operations after the window, want 1", len(fresh))
+	}
+}
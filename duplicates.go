@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Duplicate session policies, selected with the DUPLICATE_SESSION_POLICY env var
+const (
+	DuplicateSessionReject   = "reject"   // Reject the new connection while the user is connected elsewhere
+	DuplicateSessionTakeover = "takeover" // Close the user's other connections in favor of the new one
+	DuplicateSessionMultiple = "multiple" // Allow the user several connections, up to MAX_SESSIONS_PER_USER
+)
+
+var (
+	duplicateSessionPolicy = DuplicateSessionReject
+
+	// Most connections per user with the multiple policy, 0 is unlimited.
+	maxSessionsPerUser = 0
+)
+
+// users indexes the connected clients by user ID.
+var users = NewUserIndex()
+
+// loadDuplicateSessionPolicy configures how users connecting more than once are handled from the
+// DUPLICATE_SESSION_POLICY and MAX_SESSIONS_PER_USER env vars.
+func loadDuplicateSessionPolicy() {
+	switch policy := os.Getenv("DUPLICATE_SESSION_POLICY"); policy {
+	case "":
+		duplicateSessionPolicy = DuplicateSessionReject
+	case DuplicateSessionReject, DuplicateSessionTakeover, DuplicateSessionMultiple:
+		duplicateSessionPolicy = policy
+	default:
+		log.Fatalf("unknown DUPLICATE_SESSION_POLICY \"%s\"", policy)
+	}
+	maxSessionsPerUser = envInt("MAX_SESSIONS_PER_USER", 0, 0)
+	log.Infof("duplicate session policy: %s, max sessions per user %d", duplicateSessionPolicy, maxSessionsPerUser)
+}
+
+// UserIndex is a concurrency-safe index of the connected clients of each user.
+type UserIndex struct {
+	sync.Mutex
+	m map[string]map[*Client]bool
+}
+
+// NewUserIndex instantiates a UserIndex.
+func NewUserIndex() *UserIndex {
+	return &UserIndex{
+		m: make(map[string]map[*Client]bool),
+	}
+}
+
+// Claim registers c as a connection of a user, applying the duplicate session policy to the user's other
+// connections. Returns whether c may connect, the connections it takes over, and how many the user now has.
+func (u *UserIndex) Claim(userID string, c *Client, policy string, max int) (bool, []*Client, int) {
+	u.Lock()
+	defer u.Unlock()
+	conns, ok := u.m[userID]
+	if !ok {
+		conns = make(map[*Client]bool)
+		u.m[userID] = conns
+	}
+	if conns[c] {
+		// Announcing again
+		return true, nil, len(conns)
+	}
+
+	others := len(conns)
+	switch policy {
+	case DuplicateSessionReject:
+		if others > 0 {
+			return false, nil, others
+		}
+	case DuplicateSessionTakeover:
+		takenOver := make([]*Client, 0, others)
+		for other := range conns {
+			takenOver = append(takenOver, other)
+			delete(conns, other)
+		}
+		conns[c] = true
+		return true, takenOver, len(conns)
+	case DuplicateSessionMultiple:
+		if max > 0 && others >= max {
+			return false, nil, others
+		}
+	}
+	conns[c] = true
+	return true, nil, len(conns)
+}
+
+// Remove removes a connection of a user.
+func (u *UserIndex) Remove(userID string, c *Client) {
+	u.Lock()
+	defer u.Unlock()
+	conns, ok := u.m[userID]
+	if !ok {
+		return
+	}
+	delete(conns, c)
+	if len(conns) == 0 {
+		delete(u.m, userID)
+	}
+}
+
+// Count returns how many connections a user has.
+func (u *UserIndex) Count(userID string) int {
+	u.Lock()
+	defer u.Unlock()
+	return len(u.m[userID])
+}
+
+// Len returns how many users are connected.
+func (u *UserIndex) Len() int {
+	u.Lock()
+	defer u.Unlock()
+	return len(u.m)
+}
+
+// takeOver closes a connection the same user opened a newer one in favor of, telling the client why.
+// Its session ends immediately rather than being held to resume.
+func (c *Client) takeOver() {
+	log.Infof("user \"%s\" connected elsewhere, closing connection %s", c.UserID, c.connID)
+	atomic.StoreInt32(&c.takenOver, 1)
+	c.closeMessage.Store(websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session taken over by another connection"))
+	c.Send(NewErrorMessage("", NewError(ErrCodeSessionTakenOver, "", "user %s connected elsewhere", c.UserID)))
+	c.send.Close()
+}
+
+// isTakenOver returns whether the client's connection was closed in favor of a newer one.
+func (c *Client) isTakenOver() bool {
+	return atomic.LoadInt32(&c.takenOver) == 1
+}
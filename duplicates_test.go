@@ -0,0 +1,86 @@
+package main
+
+import "testing"
+
+func TestUserIndexClaim(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    string
+		max       int
+		others    int
+		ok        bool
+		takenOver int
+		count     int
+	}{
+		{"reject first connection", DuplicateSessionReject, 0, 0, true, 0, 1},
+		{"reject second connection", DuplicateSessionReject, 0, 1, false, 0, 1},
+		{"takeover", DuplicateSessionTakeover, 0, 2, true, 2, 1},
+		{"multiple", DuplicateSessionMultiple, 0, 2, true, 0, 3},
+		{"multiple under the limit", DuplicateSessionMultiple, 2, 1, true, 0, 2},
+		{"multiple at the limit", DuplicateSessionMultiple, 2, 2, false, 0, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			index := NewUserIndex()
+			for i := 0; i < test.others; i++ {
+				index.Claim("alice", newTestClient("alice"), DuplicateSessionMultiple, 0)
+			}
+			c := newTestClient("alice")
+			ok, takenOver, count := index.Claim("alice", c, test.policy, test.max)
+			if ok != test.ok || len(takenOver) != test.takenOver || count != test.count {
+				t.Errorf("got ok %t, %d taken over, count %d, want %t, %d, %d", ok, len(takenOver), count, test.ok, test.takenOver, test.count)
+			}
+
+			// Announcing again keeps the claim
+			if ok {
+				if again, _, _ := index.Claim("alice", c, test.policy, test.max); !again {
+					t.Errorf("announcing again was rejected")
+				}
+			}
+			if index.Count("alice") != test.count {
+				t.Errorf("got %d connections, want %d", index.Count("alice"), test.count)
+			}
+		})
+	}
+
+	// Removing the last connection forgets the user
+	index := NewUserIndex()
+	c := newTestClient("alice")
+	index.Claim("alice", c, DuplicateSessionReject, 0)
+	index.Remove("alice", c)
+	if index.Len() != 0 {
+		t.Errorf("got %d users after removing the connection, want 0", index.Len())
+	}
+}
+
+func TestAnnounceHandlerTakeover(t *testing.T) {
+	defer func(policy string, v TokenVerifier) {
+		duplicateSessionPolicy, verifier = policy, v
+	}(duplicateSessionPolicy, verifier)
+	duplicateSessionPolicy = DuplicateSessionTakeover
+	verifier = localVerifier{}
+	users = NewUserIndex()
+
+	announce := &AnnounceMessage{ProtocolVersion: ProtocolVersion, IDToken: "alice"}
+	old := newTestClient("")
+	if res, _ := AnnounceHandler(old, announce); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	c := newTestClient("")
+	res, _ := AnnounceHandler(c, announce)
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if res.Sessions != 1 {
+		t.Errorf("got %d sessions, want 1", res.Sessions)
+	}
+
+	// The old connection is told why it is closing
+	m, ok := nextMessage(old).(*ErrorMessage)
+	if !ok || m.Error.Code != ErrCodeSessionTakenOver {
+		t.Errorf("got message %+v, want %s", m, ErrCodeSessionTakenOver)
+	}
+	if !old.isTakenOver() {
+		t.Errorf("old connection isn't marked as taken over")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Error codes sent to websocket clients
+const (
+	ErrCodeBadMessage       = "BAD_MESSAGE"          // The message could not be decoded
+	ErrCodeUnknownType      = "UNKNOWN_MESSAGE_TYPE" // The message type is not implemented
+	ErrCodeUpgradeRequired  = "UPGRADE_REQUIRED"     // The client's protocol version is no longer supported
+	ErrCodeAlreadyConnected = "ALREADY_CONNECTED"    // The user is already connected on another connection
+	ErrCodeNotInRoom        = "NOT_IN_ROOM"          // The message requires the client to be in a room
+	ErrCodeRoomNotFound     = "ROOM_NOT_FOUND"       // The room does not exist
+	ErrCodeStoreTimeout     = "STORE_TIMEOUT"        // The store did not respond in time
+	ErrCodeStoreError       = "STORE_ERROR"          // The store failed
+	ErrCodeSlowConsumer     = "SLOW_CONSUMER"        // The client fell too far behind and is being disconnected
+	ErrCodeTooManyActions   = "TOO_MANY_ACTIONS"     // The submission has more operations than the room allows at once
+	ErrCodeRateLimited      = "RATE_LIMITED"         // The user must wait retryAfter milliseconds before submitting again
+	ErrCodeRuleViolation    = "RULE_VIOLATION"       // Operations break the room's rules, see violations
+	ErrCodeMalformedOp      = "MALFORMED_OPERATION"  // Operations don't match the room type's schema, see violations
+	ErrCodeUnauthenticated  = "UNAUTHENTICATED"      // The client hasn't announced with a valid ID token
+	ErrCodeInvalidToken     = "INVALID_TOKEN"        // The ID token failed verification, announce again with a fresh one
+	ErrCodeSessionTakenOver = "SESSION_TAKEN_OVER"   // The user connected elsewhere, and this connection is closing
+)
+
+// retryableCodes are the error codes for which the same message may succeed if sent again.
+var retryableCodes = map[string]bool{
+	ErrCodeStoreTimeout: true,
+	ErrCodeStoreError:   true,
+	ErrCodeRateLimited:  true,
+}
+
+// ErrorInfo is the error envelope sent to websocket clients.
+type ErrorInfo struct {
+	Code        string          `json:"code"`
+	Message     string          `json:"message"`
+	Retryable   bool            `json:"retryable"`
+	MessageType string          `json:"messageType,omitempty"`
+	RetryAfter  int64           `json:"retryAfter,omitempty"` // Milliseconds to wait before sending the message again
+	Violations  []RuleViolation `json:"violations,omitempty"` // Operations that break the room's rules or schema
+}
+
+// Error implements error.
+func (e *ErrorInfo) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// NewError creates an ErrorInfo for a failure handling a message of messageType.
+func NewError(code string, messageType string, format string, args ...interface{}) *ErrorInfo {
+	return &ErrorInfo{
+		Code:        code,
+		Message:     fmt.Sprintf(format, args...),
+		Retryable:   retryableCodes[code],
+		MessageType: messageType,
+	}
+}
+
+// NewStoreError creates an ErrorInfo for a store failure, classifying it by its cause.
+func NewStoreError(err error, messageType string, format string, args ...interface{}) *ErrorInfo {
+	return NewError(storeErrorCode(err), messageType, format, args...)
+}
+
+// storeErrorCode returns the error code for a store error.
+func storeErrorCode(err error) string {
+	if errors.Is(err, ErrRoomNotFound) || errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrCodeRoomNotFound
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrCodeStoreTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrCodeStoreTimeout
+	}
+	return ErrCodeStoreError
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestStoreErrorCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code string
+	}{
+		{"room not found", fmt.Errorf("unable to get room: %w", ErrRoomNotFound), ErrCodeRoomNotFound},
+		{"no documents", fmt.Errorf("database find error: %w", mongo.ErrNoDocuments), ErrCodeRoomNotFound},
+		{"deadline", fmt.Errorf("database find error: %w", context.DeadlineExceeded), ErrCodeStoreTimeout},
+		{"network timeout", fmt.Errorf("database find error: %w", timeoutError{}), ErrCodeStoreTimeout},
+		{"anything else", errors.New("database find error"), ErrCodeStoreError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info := NewStoreError(test.err, TypeEnterRoom, "unable to get room: %s", test.err)
+			if info.Code != test.code {
+				t.Errorf("got code %s, want %s", info.Code, test.code)
+			}
+			if info.Retryable != retryableCodes[test.code] || info.MessageType != TypeEnterRoom {
+				t.Errorf("got %+v", info)
+			}
+		})
+	}
+}
+
+func TestHandlerErrorCodes(t *testing.T) {
+	newTestRoom(t, "room", "alice", bson.M{})
+	c := newTestClient("bob")
+
+	if res := FetchOperationsHandler(c, &FetchOperationsMessage{Envelope: Envelope{ID: "1", Type: TypeFetchOperations}}); res.Error == nil || res.Error.Code != ErrCodeNotInRoom {
+		t.Errorf("got error %v fetching outside a room, want %s", res.Error, ErrCodeNotInRoom)
+	}
+	if res := ExitRoomHandler(c, &ExitRoomMessage{Envelope: Envelope{ID: "2", Type: TypeExitRoom}, RoomName: "room"}); res.Error == nil || res.Error.Code != ErrCodeNotInRoom {
+		t.Errorf("got error %v exiting outside a room, want %s", res.Error, ErrCodeNotInRoom)
+	}
+	if _, res := OperationsHandler(c, &OperationsMessage{Envelope: Envelope{ID: "3", Type: TypeOperations}}); res == nil || res.Error.Code != ErrCodeNotInRoom || res.ID != "3" {
+		t.Errorf("got response %+v committing outside a room, want %s", res, ErrCodeNotInRoom)
+	}
+}
@@ -14,6 +14,8 @@ import (
 	"firebase.google.com/go/auth"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // Timeouts (in seconds) for mongodb interactions
@@ -21,19 +23,21 @@ const (
 	FSTimeoutOp = 2
 )
 
-// fb is the common reference to firebase
-var fb *Firebase
+// DefaultEmulatorProjectID is the project used with the firestore emulator, unless FIREBASE_PROJECT_ID is set.
+const DefaultEmulatorProjectID = "demo-nime2020"
 
-// Firebase is a wrapper around a firebase client
+// Firebase is a wrapper around a firebase client, serving as the room metadata source and user directory
 type Firebase struct {
 	firestoreClient *firestore.Client
 	authClient      *auth.Client
 	roomCol         *firestore.CollectionRef
+	userCol         *firestore.CollectionRef
 }
 
 // NewFirebase creates a firebase client.
 func NewFirebase() *Firebase {
-	ctx, _ := context.WithTimeout(context.Background(), FSTimeoutOp*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), FSTimeoutOp*time.Second)
+	defer cancel()
 	firebaseCredentialsJSON := os.Getenv("FIREBASE_CREDENTIALS_JSON")
 	sa := option.WithCredentialsJSON([]byte(firebaseCredentialsJSON))
 	app, err := firebase.NewApp(ctx, nil, sa)
@@ -41,13 +45,15 @@ func NewFirebase() *Firebase {
 		log.Fatal(fmt.Sprintf("unable to create firebase app: %s", err))
 	}
 
-	ctx, _ = context.WithTimeout(context.Background(), FSTimeoutOp*time.Second)
+	ctx, cancel = context.WithTimeout(context.Background(), FSTimeoutOp*time.Second)
+	defer cancel()
 	firestoreClient, err := app.Firestore(ctx)
 	if err != nil {
 		log.Fatal(fmt.Sprintf("unable to create firestore client: %s", err))
 	}
 
-	ctx, _ = context.WithTimeout(context.Background(), FSTimeoutOp*time.Second)
+	ctx, cancel = context.WithTimeout(context.Background(), FSTimeoutOp*time.Second)
+	defer cancel()
 	authClient, err := app.Auth(ctx)
 	if err != nil {
 		log.Fatal(fmt.Sprintf("unable to create auth client: %s", err))
@@ -57,23 +63,110 @@ func NewFirebase() *Firebase {
 		firestoreClient: firestoreClient,
 		authClient:      authClient,
 		roomCol:         firestoreClient.Collection("rooms"),
+		userCol:         firestoreClient.Collection("users"),
+	}
+}
+
+// NewFirestoreEmulator creates a client for the firestore emulator at FIRESTORE_EMULATOR_HOST, which needs no
+// credentials. There is no auth client, so ID tokens can't be verified and users can't be deleted.
+func NewFirestoreEmulator() *Firebase {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		log.Fatal("FIRESTORE_EMULATOR_HOST must be set to use the firestore emulator")
+	}
+	projectID := os.Getenv("FIREBASE_PROJECT_ID")
+	if projectID == "" {
+		projectID = DefaultEmulatorProjectID
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), FSTimeoutOp*time.Second)
+	defer cancel()
+	firestoreClient, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("unable to create firestore emulator client: %s", err))
+	}
+
+	return &Firebase{
+		firestoreClient: firestoreClient,
+		roomCol:         firestoreClient.Collection("rooms"),
+		userCol:         firestoreClient.Collection("users"),
 	}
 }
 
 // GetRoom retrieves a room from firestore.
 func (fb *Firebase) GetRoom(roomName string) (bson.M, error) {
-	ctx, _ := context.WithTimeout(context.Background(), FSTimeoutOp*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), FSTimeoutOp*time.Second)
+	defer cancel()
 	doc, err := fb.roomCol.Doc(roomName).Get(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get room from firestore: %s", err)
+		if status.Code(err) == codes.NotFound {
+			return nil, fmt.Errorf("%w: %s", ErrRoomNotFound, roomName)
+		}
+		return nil, fmt.Errorf("unable to get room from firestore: %w", err)
 	}
 	return doc.Data(), nil
 }
 
+// SetRoom creates or replaces a room in firestore.
+func (fb *Firebase) SetRoom(roomName string, data bson.M) error {
+	ctx, cancel := context.WithTimeout(context.Background(), FSTimeoutOp*time.Second)
+	defer cancel()
+	_, err := fb.roomCol.Doc(roomName).Set(ctx, map[string]interface{}(data))
+	if err != nil {
+		return fmt.Errorf("unable to set room in firestore: %s", err)
+	}
+	return nil
+}
+
+// VerifyIDToken verifies a firebase ID token, returning the UID of the user it was issued to.
+func (fb *Firebase) VerifyIDToken(idToken string) (string, error) {
+	if fb.authClient == nil {
+		return "", fmt.Errorf("firebase auth is not configured")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), FSTimeoutOp*time.Second)
+	defer cancel()
+	token, err := fb.authClient.VerifyIDToken(ctx, idToken)
+	if err != nil {
+		return "", fmt.Errorf("unable to verify ID token: %w", err)
+	}
+	return token.UID, nil
+}
+
+// GetLastOperation retrieves when a user last submitted operations in a room, or 0 if they never have.
+func (fb *Firebase) GetLastOperation(userID string, roomName string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), FSTimeoutOp*time.Second)
+	defer cancel()
+	doc, err := fb.userCol.Doc(userID).Collection("lastOperations").Doc(roomName).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("unable to get last operation from firestore: %w", err)
+	}
+	return opInt(doc.Data(), "lastOperation"), nil
+}
+
+// SetLastOperation records when a user last submitted operations in a room.
+func (fb *Firebase) SetLastOperation(userID string, roomName string, lastOperation int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), FSTimeoutOp*time.Second)
+	defer cancel()
+	_, err := fb.userCol.Doc(userID).Collection("lastOperations").Doc(roomName).Set(ctx, map[string]interface{}{
+		"lastOperation": lastOperation,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to set last operation in firestore: %w", err)
+	}
+	return nil
+}
+
 // DeleteAllUsers deletes all users from firebase. Be careful.
 func (fb *Firebase) DeleteAllUsers() error {
+	if fb.authClient == nil {
+		return fmt.Errorf("firebase auth is not configured")
+	}
+
 	// Get all users
-	ctx, _ := context.WithTimeout(context.Background(), FSTimeoutOp*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), FSTimeoutOp*time.Second)
+	defer cancel()
 	iter := fb.authClient.Users(ctx, "")
 	for {
 		// Get the next user
@@ -87,8 +180,9 @@ func (fb *Firebase) DeleteAllUsers() error {
 
 		// Delete user
 		log.Debugf("deleting user %s", user.UID)
-		ctx, _ := context.WithTimeout(context.Background(), FSTimeoutOp*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), FSTimeoutOp*time.Second)
 		err = fb.authClient.DeleteUser(ctx, user.UID)
+		cancel()
 		if err != nil {
 			log.Fatalf("unable to delete user %s: %s", user.UID, err)
 		}
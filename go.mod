@@ -14,7 +14,10 @@ require (
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.1 // indirect
 	github.com/sirupsen/logrus v1.5.0
+	github.com/vmihailenco/msgpack/v4 v4.3.12
 	go.mongodb.org/mongo-driver v1.3.2
 	google.golang.org/api v0.22.0
 	google.golang.org/appengine v1.6.6 // indirect
+	google.golang.org/grpc v1.28.0
+	gopkg.in/yaml.v2 v2.2.8
 )
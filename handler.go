@@ -1,43 +1,116 @@
 package main
 
 import (
-	"fmt"
+	"math"
 
 	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
-// AnnounceHandler registers a user with a client connection.
-func AnnounceHandler(c *Client, m *Message) bson.M {
-	ok := true
-	f := func(client *Client, _ bool) bool {
-		if client.UserID == m.UserID {
-			ok = false
-			return false
+// AnnounceHandler registers the user verified by an ID token with a client connection, negotiating the protocol
+// version and encoding.
+// If the client resumes a session, the operations it missed are returned to be replayed after the response.
+func AnnounceHandler(c *Client, m *AnnounceMessage) (*AnnounceResponse, *OperationsUpdateMessage) {
+	version, upgradeRequired := negotiateProtocol(m.ProtocolVersion)
+	c.upgradeRequired = upgradeRequired
+	if upgradeRequired {
+		log.Infof("user \"%s\" announced with protocol version %d, upgrade required", m.UserID, version)
+		return &AnnounceResponse{
+			Response: Response{
+				ID:    m.ID,
+				Error: NewError(ErrCodeUpgradeRequired, TypeAnnounce, "protocol version %d is no longer supported, minimum is %d", version, minProtocolVersion),
+			},
+			ProtocolVersion:    ProtocolVersion,
+			MinProtocolVersion: minProtocolVersion,
+			Capabilities:       serverCapabilities,
+			UpgradeRequired:    true,
+			Encoding:           c.Codec().Name(),
+			Encodings:          supportedEncodings,
+		}, nil
+	}
+	c.ProtocolVersion = version
+	c.SetCapabilities(m.Capabilities)
+
+	// Switch encodings if requested, starting with this response
+	if m.Encoding != "" {
+		codec, err := getCodec(m.Encoding)
+		if err != nil {
+			log.Warnf("user \"%s\" requested an unsupported encoding: %s", m.UserID, err)
+		} else {
+			c.SetCodec(codec)
 		}
-		return true
 	}
-	clients.Range(f)
+	encoding := c.Codec().Name()
 
+	// Verify who the user is, rather than trusting the claimed user ID
+	uid, errInfo := authenticate(c, m)
+	if errInfo != nil {
+		return &AnnounceResponse{
+			Response: Response{
+				ID:    m.ID,
+				Error: errInfo,
+			},
+			ProtocolVersion:    version,
+			MinProtocolVersion: minProtocolVersion,
+			Capabilities:       serverCapabilities,
+			Encoding:           encoding,
+			Encodings:          supportedEncodings,
+		}, nil
+	}
+
+	// Apply the duplicate session policy if the user is connected elsewhere
+	ok, takenOver, sessionCount := users.Claim(uid, c, duplicateSessionPolicy, maxSessionsPerUser)
 	if !ok {
-		c.UserID = m.UserID
-		log.Warnf("(WARNING: multiple instances of the same user) user \"%s\" announced", m.UserID)
-		return bson.M{
-			"id":    m.ID,
-			"error": fmt.Sprintf("user %s already connected", m.UserID),
-		}
+		log.Warnf("user \"%s\" announced while connected %d times, rejected by the %s policy", uid, sessionCount, duplicateSessionPolicy)
+		return &AnnounceResponse{
+			Response: Response{
+				ID:    m.ID,
+				Error: NewError(ErrCodeAlreadyConnected, TypeAnnounce, "user %s already connected", uid),
+			},
+			ProtocolVersion:    version,
+			MinProtocolVersion: minProtocolVersion,
+			Capabilities:       serverCapabilities,
+			Encoding:           encoding,
+			Encodings:          supportedEncodings,
+		}, nil
 	}
+	for _, old := range takenOver {
+		old.takeOver()
+	}
+
+	c.UserID = uid
+	log.Debugf("user \"%s\" announced with protocol version %d", uid, version)
 
-	c.UserID = m.UserID
-	log.Debugf("user \"%s\" announced", m.UserID)
+	// Resume the session of a dropped connection, if the client has one
+	var replay *OperationsUpdateMessage
+	resumed := false
+	if m.SessionToken != "" {
+		operations, ok := resumeSession(c, m.SessionToken, uid, m.SinceSeq, m.SinceBucket)
+		if ok {
+			resumed = true
+			replay = NewOperationsUpdateMessage(operations, 0)
+		}
+	}
 
-	return bson.M{
-		"id": m.ID,
+	res := &AnnounceResponse{
+		Response:           Response{ID: m.ID},
+		ProtocolVersion:    version,
+		MinProtocolVersion: minProtocolVersion,
+		Capabilities:       serverCapabilities,
+		Encoding:           encoding,
+		Encodings:          supportedEncodings,
+		SessionToken:       c.ensureSession(),
+		Resumed:            resumed,
+		Sessions:           sessionCount,
+	}
+	if resumed {
+		res.RoomName = c.Room.RoomName
 	}
+	return res, replay
 }
 
 // EnterRoomHandler registers a client with a room.
-func EnterRoomHandler(c *Client, m *Message) bson.M {
+func EnterRoomHandler(c *Client, m *EnterRoomMessage) *EnterRoomResponse {
 	// Get room
 	room, ok := rooms.Get(m.RoomName)
 	if !ok {
@@ -53,9 +126,11 @@ func EnterRoomHandler(c *Client, m *Message) bson.M {
 	// Get room data (creates from firestore if doesn't exist)
 	doc, err := database.GetRoom(m.RoomName)
 	if err != nil {
-		return bson.M{
-			"id":    m.ID,
-			"error": fmt.Sprintf("unable to get room: %s", err),
+		return &EnterRoomResponse{
+			Response: Response{
+				ID:    m.ID,
+				Error: NewStoreError(err, TypeEnterRoom, "unable to get room: %s", err),
+			},
 		}
 	}
 
@@ -63,40 +138,34 @@ func EnterRoomHandler(c *Client, m *Message) bson.M {
 	// 	but do not add client to room yet
 	c.Room = room
 
-	// TODO: optimization that isn't implenented
-	// Attempt to get room state
-	// var state bson.M
-	// var operations []bson.M
-	// existingClient := room.Members.GetRandomClient()
-	// if existingClient != nil {
-	// 	// Request full state from existing client in room
-	// 	existingClient.Send(bson.M{
-	// 		"type": TypeRequestState,
-	// 	})
-	// 	state, err = c.WaitForState()
-	// 	if err != nil {
-	// 		log.Warnf("unable to get full state: %s", err)
-	// 	}
-	// }
-	// if state == nil {
-	// 	// Fall back to sending all operations
-	// 	operations, err = database.GetAllOperations(m.RoomName)
-	// 	if err != nil {
-	// 		c.Room = nil
-	// 		return bson.M{
-	// 			"id":    m.ID,
-	// 			"error": fmt.Sprintf("unable to get full state or all operations: %s", err),
-	// 		}
-	// 	}
-	// }
-
-	// Get all operations
-	operations, err := database.GetAllOperations(m.RoomName)
-	if err != nil {
-		c.Room = nil
-		return bson.M{
-			"id":    m.ID,
-			"error": fmt.Sprintf("unable to get full state or all operations: %s", err),
+	// Attempt to get room state from an existing member if configured and the client accepts it,
+	// 	falling back to the snapshot and operation log
+	var state bson.M
+	var snapshot *SnapshotDoc
+	var operations []bson.M
+	joinPath := JoinPathLog
+	if joinStrategy == JoinStrategyPeer && m.SinceSeq <= 0 && c.HasCapability(CapPeerState) {
+		state, operations, err = getPeerState(c, room, doc)
+		if err != nil {
+			log.Warnf("unable to get full state from peer: %s", err)
+		} else {
+			joinPath = JoinPathPeer
+		}
+	}
+	if joinPath == JoinPathLog {
+		// Get the snapshot and all operations after it, or only those missed if the client provides a cursor
+		snapshot, operations, err = getOperations(m.RoomName, m.SinceSeq, m.SinceBucket, c.HasCapability(CapSnapshots))
+		if err != nil {
+			c.Room = nil
+			return &EnterRoomResponse{
+				Response: Response{
+					ID:    m.ID,
+					Error: NewStoreError(err, TypeEnterRoom, "unable to get full state or all operations: %s", err),
+				},
+			}
+		}
+		if snapshot != nil {
+			joinPath = JoinPathSnapshot
 		}
 	}
 
@@ -104,89 +173,312 @@ func EnterRoomHandler(c *Client, m *Message) bson.M {
 	doc, err = database.UpdateRoomNumMembers(m.RoomName, 1)
 	if err != nil {
 		c.Room = nil
-		return bson.M{
-			"id":    m.ID,
-			"error": fmt.Sprintf("unable to increment room num_members: %s", err),
+		return &EnterRoomResponse{
+			Response: Response{
+				ID:    m.ID,
+				Error: NewStoreError(err, TypeEnterRoom, "unable to increment room num_members: %s", err),
+			},
 		}
 	}
 
 	// Update clients with num_members
-	c.Room.Broadcast(bson.M{
-		"type":       TypeNumMembersUpdate,
-		"numMembers": doc.NumMembers,
-	}, c)
+	c.Room.Broadcast(NewNumMembersUpdateMessage(doc.NumMembers), c)
 
 	// Add client to room
 	room.Members.Set(c, true)
 
-	return bson.M{
-		"id":         m.ID,
-		"roomDoc":    doc,
-		"operations": operations,
+	return &EnterRoomResponse{
+		Response:     Response{ID: m.ID},
+		RoomDoc:      doc,
+		Operations:   operations,
+		JoinPath:     joinPath,
+		Snapshot:     snapshot,
+		State:        state,
+		SessionToken: c.ensureSession(),
 	}
 }
 
 // ExitRoomHandler unregisters a client from a room.
-func ExitRoomHandler(c *Client, m *Message) bson.M {
+func ExitRoomHandler(c *Client, m *ExitRoomMessage) *ExitRoomResponse {
 	// Check if client is in room
 	if c.Room == nil {
-		return bson.M{
-			"id":    m.ID,
-			"error": fmt.Sprintf("user %s is not in a room to exit", c.UserID),
+		return &ExitRoomResponse{
+			Response: Response{
+				ID:    m.ID,
+				Error: NewError(ErrCodeNotInRoom, TypeExitRoom, "user %s is not in a room to exit", c.UserID),
+			},
 		}
 	}
 
 	// Decrement room num_members
 	doc, err := database.UpdateRoomNumMembers(m.RoomName, -1)
 	if err != nil {
-		return bson.M{
-			"id":    m.ID,
-			"error": fmt.Sprintf("unable to decrement room num_members: %s", err),
+		return &ExitRoomResponse{
+			Response: Response{
+				ID:    m.ID,
+				Error: NewStoreError(err, TypeExitRoom, "unable to decrement room num_members: %s", err),
+			},
 		}
 	}
 
 	// Update clients with num_members
-	c.Room.Broadcast(bson.M{
-		"type":       TypeNumMembersUpdate,
-		"numMembers": doc.NumMembers,
-	}, c)
+	c.Room.Broadcast(NewNumMembersUpdateMessage(doc.NumMembers), c)
 
 	c.Room.Members.Delete(c)
 	c.Room = nil
-	return bson.M{
-		"id": m.ID,
+	return &ExitRoomResponse{
+		Response: Response{ID: m.ID},
+	}
+}
+
+// OperationsHandler commits operations to a room, returning the update to broadcast and the response to send, if any.
+func OperationsHandler(c *Client, m *OperationsMessage) (*OperationsUpdateMessage, *OperationsResponse) {
+	if c.Room == nil {
+		return nil, &OperationsResponse{
+			Response: Response{
+				ID:    m.ID,
+				Error: NewError(ErrCodeNotInRoom, TypeOperations, "user %s is not in a room to commit operations", c.UserID),
+			},
+		}
+	}
+
+	// Reject operations that don't match the schema for the room's type, normalizing the fields of the rest
+	metadata := c.Room.Metadata()
+	if invalid := ValidateOperations(metadata.Type, m.Operations); len(invalid) > 0 {
+		errInfo := NewError(ErrCodeMalformedOp, TypeOperations, "%d malformed operations for room type %s", len(invalid), metadata.Type)
+		errInfo.Violations = invalid
+		return nil, &OperationsResponse{
+			Response: Response{
+				ID:    m.ID,
+				Error: errInfo,
+			},
+		}
+	}
+
+	// Enforce the room's rules, clamping values into range where allowed
+	violations, adjustments := ApplyRules(metadata.Rules, m.Operations, nowMillis())
+	if len(violations) > 0 {
+		errInfo := NewError(ErrCodeRuleViolation, TypeOperations, "%d violations of the rules of room %s", len(violations), c.Room.RoomName)
+		errInfo.Violations = violations
+		return nil, &OperationsResponse{
+			Response: Response{
+				ID:    m.ID,
+				Error: errInfo,
+			},
+		}
+	}
+
+	// Retried operations that were already committed are acknowledged again, so they don't count towards the limits
+	committed, err := database.GetCommittedOperations(c.Room.RoomName, opIDs(m.Operations))
+	if err != nil {
+		return nil, &OperationsResponse{
+			Response: Response{
+				ID:    m.ID,
+				Error: NewStoreError(err, TypeOperations, "unable to get committed operations: %s", err),
+			},
+		}
+	}
+	_, unseen := dedupeOperations(m.Operations, committed)
+
+	// Enforce the room's limits on how many operations a user submits, and how often
+	reservation, errInfo := reserveActions(c, len(unseen))
+	if errInfo != nil {
+		return nil, &OperationsResponse{
+			Response: Response{
+				ID:    m.ID,
+				Error: errInfo,
+			},
+		}
+	}
+
+	ops, fresh, err := database.CommitOperations(c.Room.RoomName, m.Operations)
+	if err != nil {
+		reservation.Release()
+		return nil, &OperationsResponse{
+			Response: Response{
+				ID:    m.ID,
+				Error: NewStoreError(err, TypeOperations, "unable to commit operation: %s", err),
+			},
+		}
+	}
+
+	reservation.Commit()
+
+	// Acknowledge with the assigned sequence numbers if the client will match a response
+	var res *OperationsResponse
+	if m.ID != "" {
+		seqs := make([]int64, len(ops))
+		for i, op := range ops {
+			seqs[i] = opSeq(op)
+		}
+		res = &OperationsResponse{
+			Response:    Response{ID: m.ID},
+			Seqs:        seqs,
+			Adjustments: adjustments,
+		}
+	}
+
+	// Retried operations were already broadcast
+	if len(fresh) == 0 {
+		return nil, res
 	}
+	return NewOperationsUpdateMessage(fresh, m.MessageTime), res
 }
 
-// OperationsHandler commits operations to a room.
-func OperationsHandler(c *Client, m *Message) (bson.M, bson.M) {
+// FetchOperationsHandler returns the operations committed in the client's room since a sequence number.
+func FetchOperationsHandler(c *Client, m *FetchOperationsMessage) *FetchOperationsResponse {
 	if c.Room == nil {
-		return nil, bson.M{
-			"error": fmt.Sprintf("user %s is not in a room to commit operations", c.UserID),
+		return &FetchOperationsResponse{
+			Response: Response{
+				ID:    m.ID,
+				Error: NewError(ErrCodeNotInRoom, TypeFetchOperations, "user %s is not in a room to fetch operations", c.UserID),
+			},
 		}
 	}
-	ops, err := database.CommitOperations(c.Room.RoomName, m.Operations)
+
+	snapshot, operations, err := getOperations(c.Room.RoomName, m.SinceSeq, m.SinceBucket, c.HasCapability(CapSnapshots))
+	if err != nil {
+		return &FetchOperationsResponse{
+			Response: Response{
+				ID:    m.ID,
+				Error: NewStoreError(err, TypeFetchOperations, "unable to fetch operations: %s", err),
+			},
+		}
+	}
+
+	return &FetchOperationsResponse{
+		Response:   Response{ID: m.ID},
+		Operations: operations,
+		Snapshot:   snapshot,
+	}
+}
+
+// HistoryHandler returns the operations committed in the client's room up to a sequence number or time.
+func HistoryHandler(c *Client, m *HistoryMessage) *HistoryResponse {
+	if c.Room == nil {
+		return &HistoryResponse{
+			Response: Response{
+				ID:    m.ID,
+				Error: NewError(ErrCodeNotInRoom, TypeHistory, "user %s is not in a room to get history", c.UserID),
+			},
+		}
+	}
+
+	operations, err := GetHistory(c.Room.RoomName, m.UntilSeq, m.UntilTime)
+	if err != nil {
+		return &HistoryResponse{
+			Response: Response{
+				ID:    m.ID,
+				Error: NewStoreError(err, TypeHistory, "unable to get history: %s", err),
+			},
+		}
+	}
+
+	return &HistoryResponse{
+		Response:   Response{ID: m.ID},
+		Operations: operations,
+	}
+}
+
+// TimelineHandler returns a summary of when operations were committed in the client's room.
+func TimelineHandler(c *Client, m *TimelineMessage) *TimelineResponse {
+	if c.Room == nil {
+		return &TimelineResponse{
+			Response: Response{
+				ID:    m.ID,
+				Error: NewError(ErrCodeNotInRoom, TypeTimeline, "user %s is not in a room to get timeline", c.UserID),
+			},
+		}
+	}
+
+	timeline, err := GetTimeline(c.Room.RoomName)
 	if err != nil {
-		return nil, bson.M{
-			"error": fmt.Sprintf("unable to commit operation: %s", err),
+		return &TimelineResponse{
+			Response: Response{
+				ID:    m.ID,
+				Error: NewStoreError(err, TypeTimeline, "unable to get timeline: %s", err),
+			},
+		}
+	}
+
+	return &TimelineResponse{
+		Response: Response{ID: m.ID},
+		Timeline: timeline,
+	}
+}
+
+// getOperations returns the operations after the sinceSeq cursor. If the client applies snapshots, and there is no
+// cursor or the cursor is older than the room's snapshot, the snapshot is returned along with the operations after it.
+// Otherwise the operations come from the full log, including archived buckets.
+func getOperations(roomName string, sinceSeq int64, sinceBucket int, snapshots bool) (*SnapshotDoc, []bson.M, error) {
+	if !snapshots {
+		operations, err := getOperationLog(roomName, sinceSeq, sinceBucket)
+		return nil, operations, err
+	}
+	snapshot, err := database.GetSnapshot(roomName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if snapshot != nil && (sinceSeq <= 0 || sinceSeq < snapshot.LastSeq) {
+		// The bucket watermark already excludes folded operations, so include any without a sequence number
+		operations, err := database.GetOperationsSince(roomName, -1, snapshot.Bucket+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		return snapshot, operations, nil
+	}
+	operations, err := getOperationLog(roomName, sinceSeq, sinceBucket)
+	return nil, operations, err
+}
+
+// getOperationLog returns the operations committed in a room after the sinceSeq cursor, or all of them if there is no
+// cursor, reading archived buckets before the live ones.
+func getOperationLog(roomName string, sinceSeq int64, sinceBucket int) ([]bson.M, error) {
+	if sinceSeq <= 0 {
+		// Include any operations without a sequence number
+		sinceSeq, sinceBucket = -1, 1
+	}
+	if sinceBucket < 1 {
+		sinceBucket = 1
+	}
+	archived, err := database.GetArchivedOperationBuckets(roomName, sinceBucket, math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+	live, err := database.GetOperationsSince(roomName, sinceSeq, sinceBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	// A bucket being archived is briefly in both
+	operations := []bson.M{}
+	archivedSeqs := make(map[int64]bool)
+	for _, bucketDoc := range archived {
+		for _, op := range filterOperationsSince(bucketDoc.Ops, sinceSeq) {
+			operations = append(operations, op)
+			archivedSeqs[opSeq(op)] = true
+		}
+	}
+	for _, op := range live {
+		if seq := opSeq(op); seq > 0 && archivedSeqs[seq] {
+			continue
 		}
+		operations = append(operations, op)
 	}
-	return bson.M{
-		"type":        TypeOperationsUpdate,
-		"operations":  ops,
-		"messageTime": m.MessageTime,
-	}, nil
+	return operations, nil
 }
 
 // StateHandler receives the full state from a client in order to send to other clients who need it.
-func StateHandler(c *Client, m *Message) {
+func StateHandler(c *Client, m *StateMessage) {
 	room, ok := rooms.Get(m.RoomName)
 	if !ok {
 		log.Warnf("room %s doesn't exist", m.RoomName)
+		c.Send(NewErrorMessage(m.ID, NewError(ErrCodeRoomNotFound, TypeState, "room %s doesn't exist", m.RoomName)))
+		return
 	}
 	f := func(clientToUpdate *Client, _ bool) bool {
 		// Don't block in order to not affect individual timeouts
-		go clientToUpdate.ReceiveState(m.State)
+		go clientToUpdate.ReceiveState(m)
 		return true
 	}
 	room.NeedsState.Range(f)
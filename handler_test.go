@@ -0,0 +1,360 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// newTestRoom sets up in-memory stores serving a room with the given metadata, and a client of userID in it.
+func newTestRoom(t *testing.T, roomName string, userID string, metadata bson.M) *Client {
+	t.Helper()
+	database = NewMemoryStore()
+	roomSource = &FileRoomSource{rooms: map[string]bson.M{roomName: metadata}}
+	userDirectory = NewMemoryUserDirectory()
+	lastActions = NewActionTracker()
+	rooms = NewRoomMap()
+
+	room := &Room{
+		RoomName:   roomName,
+		Members:    NewClientMap(),
+		NeedsState: NewClientMap(),
+	}
+	rooms.Set(roomName, room)
+	c := newTestClient(userID)
+	c.Room = room
+	room.Members.Set(c, true)
+	return c
+}
+
+// newTestClient creates a client without a connection, whose outbound messages queue up in its outbox.
+func newTestClient(userID string) *Client {
+	c := &Client{
+		connID:      userID + "-conn",
+		UserID:      userID,
+		chanTimeout: 500,
+		send:        newOutbox(sendQueueSize, slowConsumerPolicy),
+		inbox:       make(chan inboundMessage, InboxSize),
+		stateUpdate: make(chan *StateMessage),
+	}
+	c.SetCapabilities(nil)
+	c.SetCodec(jsonCodec{})
+	return c
+}
+
+// nextMessage removes and returns the oldest message queued for a test client, waiting up to a second for one.
+// Returns nil if none is queued.
+func nextMessage(c *Client) interface{} {
+	timeout := time.After(time.Second)
+	for {
+		c.send.Lock()
+		if len(c.send.queue) > 0 {
+			m := c.send.queue[0]
+			c.send.queue = c.send.queue[1:]
+			c.send.Unlock()
+			return m
+		}
+		c.send.Unlock()
+		select {
+		case <-c.send.Ready():
+		case <-timeout:
+			return nil
+		}
+	}
+}
+
+// queuedMessages returns the number of messages queued for a test client.
+func queuedMessages(c *Client) int {
+	c.send.Lock()
+	defer c.send.Unlock()
+	return len(c.send.queue)
+}
+
+func TestRoomHandlers(t *testing.T) {
+	member := newTestRoom(t, "room", "alice", bson.M{})
+	database.CommitOperations("room", []bson.M{{"type": "ADD_STEP"}, {"type": "ADD_STEP"}})
+
+	// Entering gets the room's operations, and tells the members
+	c := newTestClient("bob")
+	res := EnterRoomHandler(c, &EnterRoomMessage{Envelope: Envelope{ID: "1", Type: TypeEnterRoom}, RoomName: "room"})
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if len(res.Operations) != 2 {
+		t.Errorf("got %d operations, want 2", len(res.Operations))
+	}
+	if res.RoomDoc.NumMembers != 1 {
+		t.Errorf("got %d members, want 1", res.RoomDoc.NumMembers)
+	}
+	if update := nextMessage(member).(*NumMembersUpdateMessage); update.NumMembers != 1 {
+		t.Errorf("got update %+v, want 1 member", update)
+	}
+
+	// Committed operations are returned to broadcast
+	update, errRes := OperationsHandler(c, &OperationsMessage{Envelope: Envelope{Type: TypeOperations}, Operations: []bson.M{{"type": "DELETE_STEP"}}, MessageTime: 5})
+	if errRes != nil {
+		t.Fatal(errRes.Error)
+	}
+	if len(update.Operations) != 1 || update.MessageTime != 5 {
+		t.Errorf("got update %+v, want the operation", update)
+	}
+	if all, _ := database.GetAllOperations("room"); len(all) != 3 {
+		t.Errorf("got %d operations, want 3", len(all))
+	}
+
+	// Exiting leaves the room
+	exitRes := ExitRoomHandler(c, &ExitRoomMessage{Envelope: Envelope{ID: "2", Type: TypeExitRoom}, RoomName: "room"})
+	if exitRes.Error != nil {
+		t.Fatal(exitRes.Error)
+	}
+	if _, ok := member.Room.Members.Get(c); ok || c.Room != nil {
+		t.Errorf("client is still in the room")
+	}
+	if doc, _ := database.GetRoom("room"); doc.NumMembers != 0 {
+		t.Errorf("got %d members, want 0", doc.NumMembers)
+	}
+
+	// Operations can't be committed outside a room
+	if _, errRes = OperationsHandler(c, &OperationsMessage{Envelope: Envelope{Type: TypeOperations}}); errRes == nil {
+		t.Errorf("committed operations outside a room")
+	}
+}
+
+func TestFetchOperationsHandler(t *testing.T) {
+	c := newTestRoom(t, "room", "alice", bson.M{})
+	database.(*MemoryStore).maxOpsPerBucket = 2
+	for i := 0; i < 5; i++ {
+		database.CommitOperations("room", []bson.M{{"type": "ADD_STEP"}})
+	}
+
+	tests := []struct {
+		name        string
+		sinceSeq    int64
+		sinceBucket int
+		wantSeqs    []int64
+	}{
+		{"no cursor", 0, 0, []int64{1, 2, 3, 4, 5}},
+		{"since seq", 3, 0, []int64{4, 5}},
+		{"since seq and bucket", 3, 2, []int64{4, 5}},
+		{"up to date", 5, 3, []int64{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := FetchOperationsHandler(c, &FetchOperationsMessage{Envelope: Envelope{ID: "1", Type: TypeFetchOperations}, SinceSeq: test.sinceSeq, SinceBucket: test.sinceBucket})
+			if res.Error != nil {
+				t.Fatal(res.Error)
+			}
+			if len(res.Operations) != len(test.wantSeqs) {
+				t.Fatalf("got %d operations, want %d", len(res.Operations), len(test.wantSeqs))
+			}
+			for i, op := range res.Operations {
+				if opSeq(op) != test.wantSeqs[i] {
+					t.Errorf("got seq %d, want %d", opSeq(op), test.wantSeqs[i])
+				}
+			}
+		})
+	}
+
+	c.Room = nil
+	if res := FetchOperationsHandler(c, &FetchOperationsMessage{Envelope: Envelope{ID: "2", Type: TypeFetchOperations}}); res.Error == nil {
+		t.Errorf("fetched operations outside a room")
+	}
+}
+
+func TestOperationsHandlerActionLimits(t *testing.T) {
+	c := newTestRoom(t, "limited", "user", bson.M{"actionsAllowed": 2, "actionWaitTime": 60000})
+
+	submit := func(id string, uuids ...string) *OperationsResponse {
+		ops := []bson.M{}
+		for _, uuid := range uuids {
+			ops = append(ops, bson.M{"type": "ADD_STEP", OpKeyID: uuid})
+		}
+		_, res := OperationsHandler(c, &OperationsMessage{Envelope: Envelope{ID: id}, Operations: ops})
+		return res
+	}
+
+	tests := []struct {
+		name  string
+		id    string
+		uuids []string
+		code  string
+		seqs  []int64
+	}{
+		{"first submission", "1", []string{"a", "b"}, "", []int64{1, 2}},
+		{"too many at once", "2", []string{"c", "d", "e"}, ErrCodeTooManyActions, nil},
+		{"retry is acknowledged within the wait", "3", []string{"a", "b"}, "", []int64{1, 2}},
+		{"partial retry is limited", "4", []string{"b", "c"}, ErrCodeRateLimited, nil},
+		{"retry of more than allowed is acknowledged", "5", []string{"a", "b", "a"}, "", []int64{1, 2, 1}},
+	}
+	for _, test := range tests {
+		res := submit(test.id, test.uuids...)
+		if res == nil {
+			t.Fatalf("%s: no response", test.name)
+		}
+		code := ""
+		if res.Error != nil {
+			code = res.Error.Code
+		}
+		if code != test.code {
+			t.Errorf("%s: got error %v, want %s", test.name, res.Error, test.code)
+			continue
+		}
+		if len(res.Seqs) != len(test.seqs) {
+			t.Errorf("%s: got seqs %v, want %v", test.name, res.Seqs, test.seqs)
+			continue
+		}
+		for i := range res.Seqs {
+			if res.Seqs[i] != test.seqs[i] {
+				t.Errorf("%s: got seqs %v, want %v", test.name, res.Seqs, test.seqs)
+				break
+			}
+		}
+	}
+}
+
+func TestEnterRoomHandlerSnapshots(t *testing.T) {
+	newSnapshotTestStore("room", RoomTypePianoRollSequencer, 2)
+	for i := 0; i < 5; i++ {
+		commitTestOperations(t, "room", bson.M{"type": "ADD_STEP", "n": i})
+	}
+	_, err := SnapshotRoom("room", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		capabilities []string
+		sinceSeq     int64
+		snapshot     bool
+		seqs         []int64
+	}{
+		{"legacy client gets the full log", nil, 0, false, []int64{1, 2, 3, 4, 5}},
+		{"legacy client cursor into the archive", nil, 2, false, []int64{3, 4, 5}},
+		{"snapshot client gets snapshot and tail", []string{CapSnapshots}, 0, true, []int64{5}},
+		{"snapshot client cursor into the snapshot", []string{CapSnapshots}, 2, true, []int64{5}},
+		{"snapshot client cursor after the snapshot", []string{CapSnapshots}, 4, false, []int64{5}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestClient("user")
+			c.SetCapabilities(test.capabilities)
+			res := EnterRoomHandler(c, &EnterRoomMessage{RoomName: "room", SinceSeq: test.sinceSeq})
+			if res.Error != nil {
+				t.Fatal(res.Error)
+			}
+			if (res.Snapshot != nil) != test.snapshot {
+				t.Errorf("got snapshot %v, want snapshot %t", res.Snapshot, test.snapshot)
+			}
+			if len(res.Operations) != len(test.seqs) {
+				t.Fatalf("got %d operations, want seqs %v", len(res.Operations), test.seqs)
+			}
+			for i, op := range res.Operations {
+				if opSeq(op) != test.seqs[i] {
+					t.Errorf("operation %d has seq %d, want %d", i, opSeq(op), test.seqs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEnterRoomHandlerPeerStrategy(t *testing.T) {
+	member := newTestRoom(t, "room", "member", bson.M{})
+	commitTestOperations(t, "room", bson.M{"type": "ADD_STEP"})
+	defer func(strategy string, timeout time.Duration) {
+		joinStrategy, peerStateTimeout = strategy, timeout
+	}(joinStrategy, peerStateTimeout)
+	joinStrategy = JoinStrategyPeer
+	peerStateTimeout = 5 * time.Second
+
+	tests := []struct {
+		name        string
+		memberCaps  []string
+		joiningCaps []string
+	}{
+		{"joining client without the capability", []string{CapPeerState}, nil},
+		{"no member with the capability", nil, []string{CapPeerState}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			member.SetCapabilities(test.memberCaps)
+			joining := newTestClient("joining")
+			joining.SetCapabilities(test.joiningCaps)
+
+			// Members that can't answer aren't asked, so the join doesn't wait out the timeout
+			start := time.Now()
+			res := EnterRoomHandler(joining, &EnterRoomMessage{RoomName: "room"})
+			if elapsed := time.Since(start); elapsed >= peerStateTimeout {
+				t.Errorf("join took %s, waiting for a peer", elapsed)
+			}
+			if res.Error != nil {
+				t.Fatal(res.Error)
+			}
+			if res.JoinPath != JoinPathLog || len(res.Operations) != 1 {
+				t.Errorf("got join path %s with %d operations, want the log with 1", res.JoinPath, len(res.Operations))
+			}
+			ExitRoomHandler(joining, &ExitRoomMessage{RoomName: "room"})
+			nextMessage(member) // numMembersUpdate on enter
+			nextMessage(member) // numMembersUpdate on exit
+		})
+	}
+
+	// A member that answers sends its state, along with anything committed after it. Detached members aren't asked.
+	member.SetCapabilities([]string{CapPeerState})
+	for i := 0; i < 3; i++ {
+		detached := newTestClient("detached")
+		detached.SetCapabilities([]string{CapPeerState})
+		detached.detached = 1
+		detached.Room = member.Room
+		member.Room.Members.Set(detached, true)
+	}
+	go func() {
+		req := nextMessage(member).(*RequestStateMessage)
+		database.CommitOperations("room", []bson.M{{"type": "ADD_STEP"}})
+		StateHandler(member, &StateMessage{RoomName: req.RoomName, State: bson.M{"steps": 1}, Seq: 1})
+	}()
+	joining := newTestClient("joining")
+	joining.SetCapabilities([]string{CapPeerState})
+	res := EnterRoomHandler(joining, &EnterRoomMessage{RoomName: "room"})
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if res.JoinPath != JoinPathPeer || res.State == nil {
+		t.Fatalf("got join path %s with state %v, want the peer's state", res.JoinPath, res.State)
+	}
+	if len(res.Operations) != 1 || opSeq(res.Operations[0]) != 2 {
+		t.Errorf("got operations %v after the peer state, want seq 2", res.Operations)
+	}
+}
+
+func TestAnnounceHandlerProtocol(t *testing.T) {
+	defer func(version int) { minProtocolVersion = version }(minProtocolVersion)
+	minProtocolVersion = ProtocolVersion
+	defer func(v TokenVerifier) { verifier = v }(verifier)
+	verifier = localVerifier{}
+
+	tests := []struct {
+		name            string
+		clientVersion   int
+		wantVersion     int
+		upgradeRequired bool
+	}{
+		{"legacy client", 0, LegacyProtocolVersion, true},
+		{"current client", ProtocolVersion, ProtocolVersion, false},
+		{"newer client", ProtocolVersion + 1, ProtocolVersion, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users = NewUserIndex()
+			c := newTestClient("")
+			res, _ := AnnounceHandler(c, &AnnounceMessage{UserID: "alice", IDToken: "alice", ProtocolVersion: test.clientVersion})
+			if res.UpgradeRequired != test.upgradeRequired || c.upgradeRequired != test.upgradeRequired {
+				t.Errorf("got upgrade required %t, want %t", res.UpgradeRequired, test.upgradeRequired)
+			}
+			if !test.upgradeRequired && (res.Error != nil || res.ProtocolVersion != test.wantVersion) {
+				t.Errorf("got protocol version %d (error %v), want %d", res.ProtocolVersion, res.Error, test.wantVersion)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// HistoryPageBuckets is how many buckets are read from the store at a time when walking a room's history.
+const HistoryPageBuckets = 10
+
+// millisPerMinute is the width of the per-minute timeline summary.
+const millisPerMinute = 60 * 1000
+
+// Timeline summarizes when operations were committed in a room.
+type Timeline struct {
+	RoomName string           `json:"roomName"`
+	LastSeq  int64            `json:"lastSeq"`
+	Buckets  []TimelineBucket `json:"buckets"`
+	Minutes  []TimelineMinute `json:"minutes"`
+}
+
+// TimelineBucket summarizes the operations in a single bucket.
+type TimelineBucket struct {
+	Bucket    int   `json:"bucket"`
+	Count     int   `json:"count"`
+	FirstSeq  int64 `json:"firstSeq"`
+	LastSeq   int64 `json:"lastSeq"`
+	FirstTime int64 `json:"firstTime"`
+	LastTime  int64 `json:"lastTime"`
+	Archived  bool  `json:"archived"`
+}
+
+// TimelineMinute counts the operations committed in a single minute, starting at Minute (milliseconds since the epoch).
+type TimelineMinute struct {
+	Minute int64 `json:"minute"`
+	Count  int   `json:"count"`
+}
+
+// rangeOperationBuckets calls f with each of a room's buckets, archived or not, in bucket order until f returns false.
+func rangeOperationBuckets(roomName string, f func(bucketDoc OpBucketDoc, archived bool) bool) error {
+	room, err := database.GetRoom(roomName)
+	if err != nil {
+		return fmt.Errorf("unable to get room: %w", err)
+	}
+
+	for from := 1; from <= room.NumBuckets; from += HistoryPageBuckets {
+		to := from + HistoryPageBuckets - 1
+		archivedBuckets, err := database.GetArchivedOperationBuckets(roomName, from, to)
+		if err != nil {
+			return fmt.Errorf("unable to get archived operation buckets: %w", err)
+		}
+		liveBuckets, err := database.GetOperationBuckets(roomName, from, to)
+		if err != nil {
+			return fmt.Errorf("unable to get operation buckets: %w", err)
+		}
+
+		// Prefer live buckets, in case archiving was interrupted after copying
+		page := make(map[int]OpBucketDoc)
+		archived := make(map[int]bool)
+		for _, bucketDoc := range archivedBuckets {
+			page[bucketDoc.Bucket] = bucketDoc
+			archived[bucketDoc.Bucket] = true
+		}
+		for _, bucketDoc := range liveBuckets {
+			page[bucketDoc.Bucket] = bucketDoc
+			archived[bucketDoc.Bucket] = false
+		}
+		for bucket := from; bucket <= to; bucket++ {
+			bucketDoc, ok := page[bucket]
+			if !ok {
+				continue
+			}
+			if !f(bucketDoc, archived[bucket]) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// GetHistory returns a room's operations up to and including untilSeq and untilTime (milliseconds since the epoch).
+// A zero untilSeq or untilTime is not used to limit the history.
+func GetHistory(roomName string, untilSeq int64, untilTime int64) ([]bson.M, error) {
+	ops := []bson.M{}
+	f := func(bucketDoc OpBucketDoc, _ bool) bool {
+		for _, op := range bucketDoc.Ops {
+			if untilSeq > 0 && opSeq(op) > untilSeq {
+				return false
+			}
+			if untilTime > 0 && opCommitTime(op) > untilTime {
+				return false
+			}
+			ops = append(ops, op)
+		}
+		return true
+	}
+	err := rangeOperationBuckets(roomName, f)
+	if err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+// GetTimeline summarizes a room's operations per bucket and per minute.
+func GetTimeline(roomName string) (*Timeline, error) {
+	timeline := &Timeline{
+		RoomName: roomName,
+		Buckets:  []TimelineBucket{},
+		Minutes:  []TimelineMinute{},
+	}
+	f := func(bucketDoc OpBucketDoc, archived bool) bool {
+		summary := TimelineBucket{
+			Bucket:   bucketDoc.Bucket,
+			Count:    len(bucketDoc.Ops),
+			Archived: archived,
+		}
+		for _, op := range bucketDoc.Ops {
+			seq := opSeq(op)
+			if seq > 0 {
+				if summary.FirstSeq == 0 {
+					summary.FirstSeq = seq
+				}
+				summary.LastSeq = seq
+				timeline.LastSeq = seq
+			}
+
+			commitTime := opCommitTime(op)
+			if commitTime == 0 {
+				continue
+			}
+			if summary.FirstTime == 0 {
+				summary.FirstTime = commitTime
+			}
+			summary.LastTime = commitTime
+
+			// Operations are in commit order, so minutes only need to be appended
+			minute := commitTime - commitTime%millisPerMinute
+			last := len(timeline.Minutes) - 1
+			if last >= 0 && timeline.Minutes[last].Minute == minute {
+				timeline.Minutes[last].Count++
+			} else {
+				timeline.Minutes = append(timeline.Minutes, TimelineMinute{Minute: minute, Count: 1})
+			}
+		}
+		timeline.Buckets = append(timeline.Buckets, summary)
+		return true
+	}
+	err := rangeOperationBuckets(roomName, f)
+	if err != nil {
+		return nil, err
+	}
+	return timeline, nil
+}
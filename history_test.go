@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestGetHistory(t *testing.T) {
+	newSnapshotTestStore("room", RoomTypePianoRollSequencer, 2)
+	for i := 0; i < 5; i++ {
+		commitTestOperations(t, "room", bson.M{"type": "ADD_STEP", "n": i})
+	}
+	_, err := SnapshotRoom("room", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, _ := GetHistory("room", 0, 0)
+	lastTime := opCommitTime(all[len(all)-1])
+
+	tests := []struct {
+		name      string
+		untilSeq  int64
+		untilTime int64
+		seqs      int
+	}{
+		{"everything", 0, 0, 5},
+		{"until an archived seq", 3, 0, 3},
+		{"until a live seq", 5, 0, 5},
+		{"until a time", 0, lastTime, 5},
+		{"until before the first commit", 0, 1, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ops, err := GetHistory("room", test.untilSeq, test.untilTime)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ops) != test.seqs {
+				t.Fatalf("got %d operations, want %d", len(ops), test.seqs)
+			}
+			for i, op := range ops {
+				if opSeq(op) != int64(i+1) {
+					t.Errorf("operation %d has seq %d, want %d", i, opSeq(op), i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestGetTimeline(t *testing.T) {
+	newSnapshotTestStore("room", RoomTypePianoRollSequencer, 2)
+	for i := 0; i < 5; i++ {
+		commitTestOperations(t, "room", bson.M{"type": "ADD_STEP", "n": i})
+	}
+	_, err := SnapshotRoom("room", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeline, err := GetTimeline("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeline.LastSeq != 5 || len(timeline.Buckets) != 3 {
+		t.Fatalf("got timeline through seq %d in %d buckets, want seq 5 in 3", timeline.LastSeq, len(timeline.Buckets))
+	}
+	want := []TimelineBucket{
+		{Bucket: 1, Count: 2, FirstSeq: 1, LastSeq: 2, Archived: true},
+		{Bucket: 2, Count: 2, FirstSeq: 3, LastSeq: 4, Archived: true},
+		{Bucket: 3, Count: 1, FirstSeq: 5, LastSeq: 5, Archived: false},
+	}
+	for i, bucket := range timeline.Buckets {
+		if bucket.FirstTime == 0 || bucket.LastTime < bucket.FirstTime {
+			t.Errorf("bucket %d spans %d to %d", bucket.Bucket, bucket.FirstTime, bucket.LastTime)
+		}
+		bucket.FirstTime, bucket.LastTime = 0, 0
+		if bucket != want[i] {
+			t.Errorf("got bucket %+v, want %+v", bucket, want[i])
+		}
+	}
+
+	count := 0
+	for _, minute := range timeline.Minutes {
+		if minute.Minute%millisPerMinute != 0 {
+			t.Errorf("minute %d doesn't start on a minute", minute.Minute)
+		}
+		count += minute.Count
+	}
+	if count != 5 {
+		t.Errorf("got %d operations across minutes, want 5", count)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Join strategies, selected with the JOIN_STRATEGY env var
+const (
+	JoinStrategyLog  = "log"  // Always send the snapshot and operation log
+	JoinStrategyPeer = "peer" // Ask an existing member for the full state, falling back to the log
+)
+
+// Paths a client took to get the room state on enterRoom
+const (
+	JoinPathLog      = "log"
+	JoinPathSnapshot = "snapshot"
+	JoinPathPeer     = "peer"
+)
+
+// DefaultPeerStateTimeout is how long (in milliseconds) to wait for a peer to provide the full state.
+const DefaultPeerStateTimeout = 500
+
+var (
+	joinStrategy     = JoinStrategyLog
+	peerStateTimeout = DefaultPeerStateTimeout * time.Millisecond
+)
+
+// loadJoinStrategy configures how clients get the room state from the JOIN_STRATEGY and PEER_STATE_TIMEOUT env vars.
+func loadJoinStrategy() {
+	switch strategy := os.Getenv("JOIN_STRATEGY"); strategy {
+	case "", JoinStrategyLog:
+		joinStrategy = JoinStrategyLog
+	case JoinStrategyPeer:
+		joinStrategy = JoinStrategyPeer
+	default:
+		log.Fatalf("unknown JOIN_STRATEGY \"%s\"", strategy)
+	}
+
+	if timeoutEnv := os.Getenv("PEER_STATE_TIMEOUT"); timeoutEnv != "" {
+		timeout, err := strconv.Atoi(timeoutEnv)
+		if err != nil || timeout <= 0 {
+			log.Fatalf("unable to parse PEER_STATE_TIMEOUT \"%s\" as a positive number of milliseconds", timeoutEnv)
+		}
+		peerStateTimeout = time.Duration(timeout) * time.Millisecond
+	}
+	log.Infof("join strategy: %s (peer state timeout %s)", joinStrategy, peerStateTimeout)
+}
+
+// getPeerState requests the full state from a random member of the room that answers requestState, verifying it is at
+// least as recent as roomDoc, and returns it with any operations committed after it.
+func getPeerState(c *Client, room *Room, roomDoc *RoomDoc) (bson.M, []bson.M, error) {
+	peer := room.Members.GetRandomClientWith(func(member *Client) bool {
+		return member != c && member.HasCapability(CapPeerState) && !member.isDetached()
+	})
+	if peer == nil {
+		return nil, nil, fmt.Errorf("no members in room %s that answer requestState", room.RoomName)
+	}
+
+	m, err := c.RequestState(peer, peerStateTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m.State == nil {
+		return nil, nil, fmt.Errorf("peer sent an empty state")
+	}
+
+	// The peer must have applied every operation committed before the request, and nothing the server hasn't committed
+	if m.Seq < roomDoc.LastSeq {
+		return nil, nil, fmt.Errorf("peer state is at seq %d, but room is at seq %d", m.Seq, roomDoc.LastSeq)
+	}
+	latest, err := database.GetRoom(room.RoomName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to verify peer state: %w", err)
+	}
+	if m.Seq > latest.LastSeq {
+		return nil, nil, fmt.Errorf("peer state is at seq %d, ahead of room at seq %d", m.Seq, latest.LastSeq)
+	}
+
+	// Operations committed after the state can only be in the current bucket or later
+	operations, err := database.GetOperationsSince(room.RoomName, m.Seq, roomDoc.NumBuckets)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get operations after peer state: %w", err)
+	}
+	return m.State, operations, nil
+}
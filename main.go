@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/gin-contrib/pprof"
@@ -13,20 +16,22 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// TODO: consider specifying buffer sizes
 // TODO: consider using sync.Pool
-var upgrader = websocket.Upgrader{}
+var upgrader = websocket.Upgrader{
+	Subprotocols: subprotocols,
+}
 
 func main() {
 	// Configure logging
 	loadLogging()
 
-	// Connect to firebase
-	fb = NewFirebase()
+	// Run a subcommand instead of the server if one is given
+	if runCommand(os.Args[1:]) {
+		return
+	}
 
-	// Connect to db
-	mongoConnectString := os.Getenv("MONGO_CONNECTION_URL")
-	database = NewDB(mongoConnectString)
+	// Connect to firebase and db
+	connect()
 
 	// Reset all NumMembers
 	err := database.ResetNumMembers()
@@ -34,6 +39,33 @@ func main() {
 		log.Fatalf("unable to reset NumMembers for all rooms: %s", err)
 	}
 
+	// Configure how announced ID tokens are verified
+	loadAuth()
+
+	// Configure supported protocol versions
+	loadProtocol()
+
+	// Configure websocket buffers, compression and limits
+	loadWebsocket()
+
+	// Configure outbound queues and how slow clients are handled
+	loadSlowConsumerPolicy()
+
+	// Configure how long sessions are held for clients to resume
+	loadSessions()
+
+	// Configure how users connecting more than once are handled
+	loadDuplicateSessionPolicy()
+
+	// Configure how long operation IDs are remembered
+	loadDedupe()
+
+	// Configure how clients entering a room get its state
+	loadJoinStrategy()
+
+	// Periodically snapshot rooms, if configured
+	StartSnapshotter()
+
 	// Create router
 	log.Infof("Creating router...")
 	r := gin.New()
@@ -77,6 +109,12 @@ func main() {
 		c.HTML(http.StatusOK, "index.html", nil)
 	})
 
+	// Websocket protocol schema
+	api := r.Group("/api")
+	api.GET("schema", func(c *gin.Context) {
+		c.JSON(http.StatusOK, GenerateSchema())
+	})
+
 	// Admin routes
 	admin := r.Group("/admin")
 	admin.Use(func(c *gin.Context) {
@@ -93,6 +131,38 @@ func main() {
 		}
 	})
 
+	// Room history routes, which expose the full operation log of any room
+	admin.GET("rooms/:roomName/history", func(c *gin.Context) {
+		roomName := c.Param("roomName")
+		untilSeq, err := parseIntQuery(c, "untilSeq")
+		if err != nil {
+			c.String(http.StatusBadRequest, "%s", err)
+			return
+		}
+		untilTime, err := parseIntQuery(c, "untilTime")
+		if err != nil {
+			c.String(http.StatusBadRequest, "%s", err)
+			return
+		}
+		operations, err := GetHistory(roomName, untilSeq, untilTime)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "unable to get history: %s", err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"operations": operations,
+		})
+	})
+	admin.GET("rooms/:roomName/timeline", func(c *gin.Context) {
+		roomName := c.Param("roomName")
+		timeline, err := GetTimeline(roomName)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "unable to get timeline: %s", err)
+			return
+		}
+		c.JSON(http.StatusOK, timeline)
+	})
+
 	// Delete room operations
 	admin.DELETE("rooms/:roomName/operations", func(c *gin.Context) {
 		roomName := c.Param("roomName")
@@ -101,12 +171,82 @@ func main() {
 			c.String(http.StatusInternalServerError, "unable to delete all operations: %s", err)
 			return
 		}
+
+		// Reset all clients
+		err = ClearRoomState(roomName)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "%s", err)
+			return
+		}
 		c.Status(http.StatusNoContent)
 	})
 
+	// Snapshot room operations
+	admin.POST("rooms/:roomName/snapshot", func(c *gin.Context) {
+		roomName := c.Param("roomName")
+		archive := c.Query("archive") == "true"
+		snapshot, err := SnapshotRoom(roomName, archive)
+		if errors.Is(err, ErrNoFolder) {
+			c.String(http.StatusBadRequest, "%s", err)
+			return
+		}
+		if err != nil {
+			c.String(http.StatusInternalServerError, "unable to snapshot room: %s", err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"roomName": snapshot.RoomName,
+			"bucket":   snapshot.Bucket,
+			"lastSeq":  snapshot.LastSeq,
+		})
+	})
+
+	// Split room operation buckets over the count or byte limits
+	admin.POST("rooms/:roomName/rebalance", func(c *gin.Context) {
+		roomName := c.Param("roomName")
+		result, err := database.RebalanceOperations(roomName)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "unable to rebalance room: %s", err)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	// Export room as an archive
+	admin.GET("rooms/:roomName/export", func(c *gin.Context) {
+		roomName := c.Param("roomName")
+		compress := c.Query("gzip") == "true"
+		filename := roomName + ".jsonl"
+		contentType := "application/x-ndjson"
+		if compress {
+			filename += ".gz"
+			contentType = "application/gzip"
+		}
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+		c.Header("Content-Type", contentType)
+		c.Status(http.StatusOK)
+		err := ExportRoom(c.Writer, roomName, compress)
+		if err != nil {
+			// Headers have already been sent, so the best that can be done is to log
+			log.Errorf("unable to export room %s: %s", roomName, err)
+		}
+	})
+
+	// Import room from an archive, optionally under a new name
+	admin.POST("rooms/:roomName/import", func(c *gin.Context) {
+		roomName := c.Param("roomName")
+		withMetadata := c.Query("metadata") == "true"
+		room, err := ImportRoom(c.Request.Body, roomName, withMetadata)
+		if err != nil {
+			c.String(http.StatusBadRequest, "unable to import room: %s", err)
+			return
+		}
+		c.JSON(http.StatusCreated, room)
+	})
+
 	// Delete all firebase users
 	admin.DELETE("firebase/users", func(c *gin.Context) {
-		err := fb.DeleteAllUsers()
+		err := userDirectory.DeleteAllUsers()
 		if err != nil {
 			c.String(http.StatusInternalServerError, "unable to delete all users: %s", err)
 			return
@@ -114,6 +254,11 @@ func main() {
 		c.Status(http.StatusNoContent)
 	})
 
+	// Connection metrics
+	admin.GET("metrics", func(c *gin.Context) {
+		c.JSON(http.StatusOK, metrics.Snapshot())
+	})
+
 	// Turn on/off websocket CORS
 	admin.POST("websocket/cors", func(c *gin.Context) {
 		// Look for "enforce" query param
@@ -153,13 +298,32 @@ func main() {
 	r.Run(":" + port)
 }
 
+// connect connects to the room metadata source, user directory and the store.
+func connect() {
+	loadMetadata()
+	database = NewStore()
+}
+
 func wsHandler(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Errorf("Unable to upgrade ws request: %s", err)
 		return
 	}
-	NewClient(conn)
+	NewClient(conn, codecForSubprotocol(conn.Subprotocol()))
+}
+
+// parseIntQuery parses an optional integer query param, returning 0 if it isn't present.
+func parseIntQuery(c *gin.Context, key string) (int64, error) {
+	param := c.Query(key)
+	if param == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseInt(param, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse query param \"%s\": %s", key, err)
+	}
+	return v, nil
 }
 
 func loadLogging() {
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryStore is an in-memory implementation of Store, for local development and tests.
+type MemoryStore struct {
+	sync.Mutex
+	rooms           map[string]*RoomDoc
+	buckets         map[string][]*OpBucketDoc
+	archive         map[string][]*OpBucketDoc
+	snapshots       map[string]*SnapshotDoc
+	opIDs           map[string]map[string]OpIDDoc
+	maxOpsPerBucket int
+	maxBucketBytes  int
+	roomLocks       *KeyedMutex
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		rooms:           make(map[string]*RoomDoc),
+		buckets:         make(map[string][]*OpBucketDoc),
+		archive:         make(map[string][]*OpBucketDoc),
+		snapshots:       make(map[string]*SnapshotDoc),
+		opIDs:           make(map[string]map[string]OpIDDoc),
+		maxOpsPerBucket: MaxOpsPerBucket,
+		maxBucketBytes:  MaxBucketBytes,
+		roomLocks:       NewKeyedMutex(),
+	}
+}
+
+// getRoom returns the room document, creating it if needed. Must be called with the lock held.
+func (s *MemoryStore) getRoom(roomName string) (*RoomDoc, error) {
+	room, ok := s.rooms[roomName]
+	if ok {
+		return room, nil
+	}
+
+	// Look up room in firestore
+	if roomSource != nil {
+		roomDoc, err := roomSource.GetRoom(roomName)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("creating room from firebase: %s", roomDoc)
+	}
+
+	room = &RoomDoc{
+		ID:         primitive.NewObjectID(),
+		RoomName:   roomName,
+		NumBuckets: 1,
+		NumMembers: 0,
+	}
+	s.rooms[roomName] = room
+	return room, nil
+}
+
+// GetRoom gets the room document given a human-readable roomName.
+func (s *MemoryStore) GetRoom(roomName string) (*RoomDoc, error) {
+	s.Lock()
+	defer s.Unlock()
+	room, err := s.getRoom(roomName)
+	if err != nil {
+		return nil, err
+	}
+	roomCopy := *room
+	return &roomCopy, nil
+}
+
+// UpdateRoomNumMembers increments/decrements the number of members in a room.
+func (s *MemoryStore) UpdateRoomNumMembers(roomName string, updateIncrement int) (*RoomDoc, error) {
+	s.Lock()
+	defer s.Unlock()
+	room, ok := s.rooms[roomName]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrRoomNotFound, roomName)
+	}
+	room.NumMembers += updateIncrement
+	roomCopy := *room
+	return &roomCopy, nil
+}
+
+// CommitOperations writes operations committed in a room, stamping each with its sequence number.
+func (s *MemoryStore) CommitOperations(roomName string, ops []bson.M) ([]bson.M, []bson.M, error) {
+	s.Lock()
+	defer s.Unlock()
+	room, err := s.getRoom(roomName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get room: %w", err)
+	}
+
+	// Skip operations already committed within the dedupe window
+	results, fresh := dedupeOperations(ops, s.getCommittedOperations(roomName, opIDs(ops)))
+
+	// Measure the operations already in the current bucket
+	buckets := s.buckets[roomName]
+	bucketCount, bucketBytes := 0, 0
+	if len(buckets) > 0 && buckets[len(buckets)-1].Bucket == room.NumBuckets {
+		bucketCount = buckets[len(buckets)-1].Count
+		bucketBytes = buckets[len(buckets)-1].Bytes
+	}
+
+	chunks, lastSeq, numBuckets := planBatch(room, bucketCount, bucketBytes, fresh, s.maxOpsPerBucket, s.maxBucketBytes)
+	for _, chunk := range chunks {
+		// Upsert the chunk's bucket
+		buckets := s.buckets[roomName]
+		var opBucket *OpBucketDoc
+		if len(buckets) > 0 && buckets[len(buckets)-1].Bucket == chunk.Bucket {
+			opBucket = buckets[len(buckets)-1]
+		} else {
+			opBucket = &OpBucketDoc{
+				ID:       primitive.NewObjectID(),
+				RoomName: roomName,
+				Bucket:   chunk.Bucket,
+			}
+			s.buckets[roomName] = append(buckets, opBucket)
+		}
+		opBucket.Count += len(chunk.Ops)
+		opBucket.Bytes += chunk.Bytes
+		opBucket.Ops = append(opBucket.Ops, chunk.Ops...)
+	}
+	room.LastSeq = lastSeq
+	room.NumBuckets = numBuckets
+
+	// Remember operation IDs
+	if s.opIDs[roomName] == nil {
+		s.opIDs[roomName] = make(map[string]OpIDDoc)
+	}
+	for _, doc := range NewOpIDDocs(roomName, fresh) {
+		s.opIDs[roomName][doc.OpID] = doc
+	}
+
+	return results, fresh, nil
+}
+
+// GetCommittedOperations returns the operations committed in a room within the dedupe window, by ID.
+func (s *MemoryStore) GetCommittedOperations(roomName string, ids []string) (map[string]bson.M, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.getCommittedOperations(roomName, ids), nil
+}
+
+// getCommittedOperations returns the operations with the given IDs committed in a room within the dedupe window,
+// forgetting the room's expired IDs. The caller must hold the lock.
+func (s *MemoryStore) getCommittedOperations(roomName string, ids []string) map[string]bson.M {
+	now := time.Now()
+	for id, doc := range s.opIDs[roomName] {
+		if !doc.ExpiresAt.After(now) {
+			delete(s.opIDs[roomName], id)
+		}
+	}
+	committed := make(map[string]bson.M)
+	for _, id := range ids {
+		if doc, ok := s.opIDs[roomName][id]; ok {
+			committed[id] = doc.Operation
+		}
+	}
+	return committed
+}
+
+// LockRoom locks a room against rebalances and other holders of the lock, returning the function to unlock it.
+// Commits hold the store's lock, so they are never part way through.
+func (s *MemoryStore) LockRoom(roomName string) func() {
+	return s.roomLocks.Lock(roomName)
+}
+
+// RebalanceOperations splits a room's buckets that are over the count or byte limits, renumbering the buckets after
+// them and the room's snapshot watermark.
+func (s *MemoryStore) RebalanceOperations(roomName string) (*RebalanceResult, error) {
+	unlock := s.roomLocks.Lock(roomName)
+	defer unlock()
+	s.Lock()
+	defer s.Unlock()
+	room, err := s.getRoom(roomName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get room: %w", err)
+	}
+
+	buckets := []OpBucketDoc{}
+	for _, bucketDoc := range s.buckets[roomName] {
+		buckets = append(buckets, *bucketDoc)
+	}
+	rebalanced, shifts := rebalanceBuckets(buckets, s.maxOpsPerBucket, s.maxBucketBytes)
+	s.buckets[roomName] = []*OpBucketDoc{}
+	for i := range rebalanced {
+		s.buckets[roomName] = append(s.buckets[roomName], &rebalanced[i])
+	}
+	room.NumBuckets = shiftBucket(room.NumBuckets, shifts)
+	if snapshot, ok := s.snapshots[roomName]; ok {
+		snapshot.Bucket = shiftBucket(snapshot.Bucket, shifts)
+	}
+
+	return &RebalanceResult{
+		RoomName:      roomName,
+		BucketsBefore: len(buckets),
+		BucketsAfter:  len(rebalanced),
+		BucketsSplit:  countSplitBuckets(shifts),
+	}, nil
+}
+
+// GetAllOperations returns the full history of operations for a given room.
+func (s *MemoryStore) GetAllOperations(roomName string) ([]bson.M, error) {
+	s.Lock()
+	defer s.Unlock()
+	all := []bson.M{}
+	for _, bucketDoc := range s.buckets[roomName] {
+		all = append(all, bucketDoc.Ops...)
+	}
+	return all, nil
+}
+
+// GetOperationsSince returns the operations for a given room with a sequence number greater than sinceSeq,
+// searching from sinceBucket onwards.
+func (s *MemoryStore) GetOperationsSince(roomName string, sinceSeq int64, sinceBucket int) ([]bson.M, error) {
+	s.Lock()
+	defer s.Unlock()
+	ops := []bson.M{}
+	for _, bucketDoc := range s.buckets[roomName] {
+		if bucketDoc.Bucket < sinceBucket {
+			continue
+		}
+		ops = append(ops, filterOperationsSince(bucketDoc.Ops, sinceSeq)...)
+	}
+	return ops, nil
+}
+
+// GetOperationBuckets returns the operation buckets for a given room from fromBucket to toBucket inclusive, in bucket order.
+func (s *MemoryStore) GetOperationBuckets(roomName string, fromBucket int, toBucket int) ([]OpBucketDoc, error) {
+	s.Lock()
+	defer s.Unlock()
+	return copyBuckets(s.buckets[roomName], fromBucket, toBucket), nil
+}
+
+// GetArchivedOperationBuckets returns the archived operation buckets for a given room from fromBucket to toBucket
+// inclusive, in bucket order.
+func (s *MemoryStore) GetArchivedOperationBuckets(roomName string, fromBucket int, toBucket int) ([]OpBucketDoc, error) {
+	s.Lock()
+	defer s.Unlock()
+	return copyBuckets(s.archive[roomName], fromBucket, toBucket), nil
+}
+
+// copyBuckets copies the buckets from fromBucket to toBucket inclusive.
+func copyBuckets(buckets []*OpBucketDoc, fromBucket int, toBucket int) []OpBucketDoc {
+	results := []OpBucketDoc{}
+	for _, bucketDoc := range buckets {
+		if bucketDoc.Bucket >= fromBucket && bucketDoc.Bucket <= toBucket {
+			bucketCopy := *bucketDoc
+			bucketCopy.Ops = append([]bson.M{}, bucketDoc.Ops...)
+			results = append(results, bucketCopy)
+		}
+	}
+	return results
+}
+
+// GetSnapshot returns the latest snapshot for a given room, or nil if there is none.
+func (s *MemoryStore) GetSnapshot(roomName string) (*SnapshotDoc, error) {
+	s.Lock()
+	defer s.Unlock()
+	snapshot, ok := s.snapshots[roomName]
+	if !ok {
+		return nil, nil
+	}
+	snapshotCopy := *snapshot
+	return &snapshotCopy, nil
+}
+
+// SaveSnapshot replaces the snapshot for the snapshot's room.
+func (s *MemoryStore) SaveSnapshot(snapshot *SnapshotDoc) error {
+	s.Lock()
+	defer s.Unlock()
+	snapshotCopy := *snapshot
+	s.snapshots[snapshot.RoomName] = &snapshotCopy
+	return nil
+}
+
+// ArchiveOperations moves the operation buckets for a given room up to throughBucket inclusive into the archive.
+// The room must be locked with LockRoom.
+func (s *MemoryStore) ArchiveOperations(roomName string, throughBucket int) error {
+	s.Lock()
+	defer s.Unlock()
+	remaining := []*OpBucketDoc{}
+	for _, bucketDoc := range s.buckets[roomName] {
+		if bucketDoc.Bucket <= throughBucket {
+			s.archive[roomName] = append(s.archive[roomName], bucketDoc)
+		} else {
+			remaining = append(remaining, bucketDoc)
+		}
+	}
+	s.buckets[roomName] = remaining
+	return nil
+}
+
+// ImportRoom creates a room with the given operation buckets, failing if the room already exists.
+func (s *MemoryStore) ImportRoom(room *RoomDoc, buckets []OpBucketDoc) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.rooms[room.RoomName]; ok {
+		return fmt.Errorf("room %s already exists", room.RoomName)
+	}
+	roomCopy := *room
+	s.rooms[room.RoomName] = &roomCopy
+	imported := []*OpBucketDoc{}
+	for i := range buckets {
+		bucketCopy := buckets[i]
+		imported = append(imported, &bucketCopy)
+	}
+	s.buckets[room.RoomName] = imported
+	return nil
+}
+
+// DeleteAllOperations deletes all operations, archived operations and snapshots for a given room.
+func (s *MemoryStore) DeleteAllOperations(roomName string) error {
+	s.Lock()
+	defer s.Unlock()
+	room, ok := s.rooms[roomName]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrRoomNotFound, roomName)
+	}
+	delete(s.buckets, roomName)
+	delete(s.archive, roomName)
+	delete(s.snapshots, roomName)
+	delete(s.opIDs, roomName)
+	room.NumBuckets = 1
+	return nil
+}
+
+// ResetNumMembers sets the numMembers to 0 for all rooms.
+func (s *MemoryStore) ResetNumMembers() error {
+	s.Lock()
+	defer s.Unlock()
+	for _, room := range s.rooms {
+		room.NumMembers = 0
+	}
+	log.Infof("reset NumMembers for %d rooms", len(s.rooms))
+	return nil
+}
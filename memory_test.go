@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMemoryStoreCommitOperations(t *testing.T) {
+	store := NewMemoryStore()
+	store.maxOpsPerBucket = 2
+
+	tests := []struct {
+		name       string
+		ops        int
+		total      int
+		numBuckets int
+	}{
+		{"first operation", 1, 1, 1},
+		{"fills the bucket", 1, 2, 2},
+		{"spans buckets", 3, 5, 3},
+		{"nothing", 0, 5, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ops := []bson.M{}
+			for i := 0; i < test.ops; i++ {
+				ops = append(ops, bson.M{"type": "ADD_STEP"})
+			}
+			_, committed, err := store.CommitOperations("room", ops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(committed) != test.ops {
+				t.Errorf("got %d committed operations, want %d", len(committed), test.ops)
+			}
+			all, _ := store.GetAllOperations("room")
+			if len(all) != test.total {
+				t.Errorf("got %d operations, want %d", len(all), test.total)
+			}
+			room, _ := store.GetRoom("room")
+			if room.NumBuckets != test.numBuckets {
+				t.Errorf("got %d buckets, want %d", room.NumBuckets, test.numBuckets)
+			}
+		})
+	}
+
+	err := store.DeleteAllOperations("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, _ := store.GetAllOperations("room")
+	room, _ := store.GetRoom("room")
+	if len(all) != 0 || room.NumBuckets != 1 {
+		t.Errorf("got %d operations in %d buckets after deleting, want none", len(all), room.NumBuckets)
+	}
+}
+
+func TestMemoryStoreNumMembers(t *testing.T) {
+	store := NewMemoryStore()
+	if _, err := store.UpdateRoomNumMembers("room", 1); err == nil {
+		t.Errorf("updated a room that doesn't exist")
+	}
+
+	// Getting a room creates it
+	room, err := store.GetRoom("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room.RoomName != "room" || room.NumBuckets != 1 || room.NumMembers != 0 {
+		t.Errorf("got new room %+v", room)
+	}
+	store.UpdateRoomNumMembers("room", 1)
+	room, _ = store.UpdateRoomNumMembers("room", 1)
+	if room.NumMembers != 2 {
+		t.Errorf("got %d members, want 2", room.NumMembers)
+	}
+
+	// Returned rooms are copies
+	room.NumMembers = 10
+	if room, _ = store.GetRoom("room"); room.NumMembers != 2 {
+		t.Errorf("modifying a returned room changed the store")
+	}
+
+	store.ResetNumMembers()
+	if room, _ = store.GetRoom("room"); room.NumMembers != 0 {
+		t.Errorf("got %d members after resetting, want 0", room.NumMembers)
+	}
+}
+
+func TestMemoryStoreSequenceNumbers(t *testing.T) {
+	store := NewMemoryStore()
+	store.maxOpsPerBucket = 2
+
+	var want int64
+	for _, n := range []int{2, 1, 3} {
+		ops := []bson.M{}
+		for i := 0; i < n; i++ {
+			ops = append(ops, bson.M{"type": "ADD_STEP"})
+		}
+		_, committed, err := store.CommitOperations("room", ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, op := range committed {
+			want++
+			if op[OpKeySeq] != want {
+				t.Errorf("got seq %v, want %d", op[OpKeySeq], want)
+			}
+			if _, ok := op[OpKeyCommitTime].(int64); !ok {
+				t.Errorf("operation %d has no commit time", want)
+			}
+		}
+	}
+
+	room, _ := store.GetRoom("room")
+	if room.LastSeq != want {
+		t.Errorf("got last seq %d, want %d", room.LastSeq, want)
+	}
+	all, _ := store.GetAllOperations("room")
+	for i, op := range all {
+		if op[OpKeySeq] != int64(i+1) {
+			t.Errorf("got seq %v at position %d", op[OpKeySeq], i)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Envelope contains the fields common to every message, and is decoded first to determine the message type.
+type Envelope struct {
+	ID   string `json:"id,omitempty"`
+	Type string `json:"type"`
+}
+
+// Response contains the fields common to every response to a client message, matched by ID.
+type Response struct {
+	ID    string     `json:"id"`
+	Error *ErrorInfo `json:"error,omitempty"`
+}
+
+// [Client->Server] messages
+
+// AnnounceMessage provides a user ID for the connection, and the protocol version, capabilities and preferred encoding
+// of the client. A session token from a dropped connection resumes its session, replaying the operations after SinceSeq.
+type AnnounceMessage struct {
+	Envelope
+	UserID          string   `json:"userID,omitempty"` // Optional, must match the ID token
+	IDToken         string   `json:"idToken"`          // Firebase ID token of the user
+	ProtocolVersion int      `json:"protocolVersion,omitempty"`
+	Capabilities    []string `json:"capabilities,omitempty"`
+	Encoding        string   `json:"encoding,omitempty"`
+	SessionToken    string   `json:"sessionToken,omitempty"`
+	SinceSeq        int64    `json:"sinceSeq,omitempty"`
+	SinceBucket     int      `json:"sinceBucket,omitempty"`
+}
+
+// EnterRoomMessage associates the client with a room, optionally only requesting operations after a cursor.
+type EnterRoomMessage struct {
+	Envelope
+	RoomName    string `json:"roomName"`
+	SinceSeq    int64  `json:"sinceSeq,omitempty"`
+	SinceBucket int    `json:"sinceBucket,omitempty"`
+}
+
+// ExitRoomMessage disassociates the client from a room.
+type ExitRoomMessage struct {
+	Envelope
+	RoomName string `json:"roomName"`
+}
+
+// OperationsMessage submits operations to the client's room.
+type OperationsMessage struct {
+	Envelope
+	RoomName      string   `json:"roomName,omitempty"`
+	OperationType string   `json:"operationType,omitempty"`
+	Operations    []bson.M `json:"operations"`
+	MessageTime   float64  `json:"messageTime,omitempty"`
+}
+
+// StateMessage sends the full state of a room, as of operation Seq.
+type StateMessage struct {
+	Envelope
+	RoomName string `json:"roomName"`
+	State    bson.M `json:"state"`
+	Seq      int64  `json:"seq"`
+}
+
+// FetchOperationsMessage requests the operations in the client's room after a cursor.
+type FetchOperationsMessage struct {
+	Envelope
+	SinceSeq    int64 `json:"sinceSeq"`
+	SinceBucket int   `json:"sinceBucket,omitempty"`
+}
+
+// HistoryMessage requests the operations in the client's room up to a sequence number and/or time.
+type HistoryMessage struct {
+	Envelope
+	UntilSeq  int64 `json:"untilSeq,omitempty"`
+	UntilTime int64 `json:"untilTime,omitempty"`
+}
+
+// TimelineMessage requests a summary of when operations were committed in the client's room.
+type TimelineMessage struct {
+	Envelope
+}
+
+// [Server->Client] responses
+
+// AnnounceResponse responds to an AnnounceMessage with the negotiated protocol version and encoding, and server capabilities.
+type AnnounceResponse struct {
+	Response
+	ProtocolVersion    int      `json:"protocolVersion"`
+	MinProtocolVersion int      `json:"minProtocolVersion"`
+	Capabilities       []string `json:"capabilities"`
+	UpgradeRequired    bool     `json:"upgradeRequired,omitempty"`
+	Encoding           string   `json:"encoding"`
+	Encodings          []string `json:"encodings"`
+	SessionToken       string   `json:"sessionToken,omitempty"`
+	Resumed            bool     `json:"resumed,omitempty"`
+	RoomName           string   `json:"roomName,omitempty"`
+	Sessions           int      `json:"sessions,omitempty"` // Connections the user has open, including this one
+}
+
+// EnterRoomResponse responds to an EnterRoomMessage with the room and its state.
+// If Chunks is set, Operations is only the first chunk, and the rest follow in operationsChunk messages.
+type EnterRoomResponse struct {
+	Response
+	RoomDoc      *RoomDoc     `json:"roomDoc,omitempty"`
+	Operations   []bson.M     `json:"operations"`
+	JoinPath     string       `json:"joinPath,omitempty"`
+	Snapshot     *SnapshotDoc `json:"snapshot,omitempty"`
+	State        bson.M       `json:"state,omitempty"`
+	Chunks       int          `json:"chunks,omitempty"`
+	SessionToken string       `json:"sessionToken,omitempty"`
+}
+
+// ExitRoomResponse responds to an ExitRoomMessage.
+type ExitRoomResponse struct {
+	Response
+}
+
+// OperationsResponse responds to an OperationsMessage when it could not be committed, or acknowledges it with the
+// sequence numbers assigned to its operations if it has an ID.
+type OperationsResponse struct {
+	Response
+	Seqs        []int64         `json:"seqs,omitempty"`
+	Adjustments []RuleViolation `json:"adjustments,omitempty"` // Operations clamped to follow the room's rules
+}
+
+// FetchOperationsResponse responds to a FetchOperationsMessage.
+type FetchOperationsResponse struct {
+	Response
+	Operations []bson.M     `json:"operations"`
+	Snapshot   *SnapshotDoc `json:"snapshot,omitempty"`
+}
+
+// HistoryResponse responds to a HistoryMessage.
+type HistoryResponse struct {
+	Response
+	Operations []bson.M `json:"operations"`
+}
+
+// TimelineResponse responds to a TimelineMessage.
+type TimelineResponse struct {
+	Response
+	Timeline *Timeline `json:"timeline,omitempty"`
+}
+
+// [Server->Client] messages
+
+// OperationsUpdateMessage disseminates committed operations to the members of a room.
+type OperationsUpdateMessage struct {
+	Envelope
+	Operations  []bson.M `json:"operations"`
+	MessageTime float64  `json:"messageTime"`
+}
+
+// RequestStateMessage asks a client for the full state of a room.
+type RequestStateMessage struct {
+	Envelope
+	RoomName string `json:"roomName"`
+}
+
+// ClearStateMessage tells a client to clear the current state.
+type ClearStateMessage struct {
+	Envelope
+}
+
+// NumMembersUpdateMessage tells a client how many members are in the room.
+type NumMembersUpdateMessage struct {
+	Envelope
+	NumMembers int `json:"numMembers"`
+}
+
+// ErrorMessage tells a client a message it sent failed, when there is no response to carry the error.
+type ErrorMessage struct {
+	Envelope
+	Error *ErrorInfo `json:"error"`
+}
+
+// NewErrorMessage creates an ErrorMessage in reply to the message with the given ID, if any.
+func NewErrorMessage(id string, err *ErrorInfo) *ErrorMessage {
+	return &ErrorMessage{
+		Envelope: Envelope{ID: id, Type: TypeError},
+		Error:    err,
+	}
+}
+
+// OperationsChunkMessage sends a chunk of the operations of a response, matched to it by ID.
+// Chunk counts from 1, as the response carries the first chunk.
+type OperationsChunkMessage struct {
+	Envelope
+	Chunk      int      `json:"chunk"`
+	Chunks     int      `json:"chunks"`
+	Operations []bson.M `json:"operations"`
+}
+
+// NewOperationsUpdateMessage creates an OperationsUpdateMessage.
+func NewOperationsUpdateMessage(operations []bson.M, messageTime float64) *OperationsUpdateMessage {
+	return &OperationsUpdateMessage{
+		Envelope:    Envelope{Type: TypeOperationsUpdate},
+		Operations:  operations,
+		MessageTime: messageTime,
+	}
+}
+
+// NewRequestStateMessage creates a RequestStateMessage.
+func NewRequestStateMessage(roomName string) *RequestStateMessage {
+	return &RequestStateMessage{
+		Envelope: Envelope{Type: TypeRequestState},
+		RoomName: roomName,
+	}
+}
+
+// NewClearStateMessage creates a ClearStateMessage.
+func NewClearStateMessage() *ClearStateMessage {
+	return &ClearStateMessage{
+		Envelope: Envelope{Type: TypeClearState},
+	}
+}
+
+// NewNumMembersUpdateMessage creates a NumMembersUpdateMessage.
+func NewNumMembersUpdateMessage(numMembers int) *NumMembersUpdateMessage {
+	return &NumMembersUpdateMessage{
+		Envelope:   Envelope{Type: TypeNumMembersUpdate},
+		NumMembers: numMembers,
+	}
+}
+
+// NewOperationsChunkMessage creates an OperationsChunkMessage.
+func NewOperationsChunkMessage(id string, chunk int, chunks int, operations []bson.M) *OperationsChunkMessage {
+	return &OperationsChunkMessage{
+		Envelope:   Envelope{ID: id, Type: TypeOperationsChunk},
+		Chunk:      chunk,
+		Chunks:     chunks,
+		Operations: operations,
+	}
+}
+
+// clientMessages maps each [Client->Server] message type to its message and response.
+var clientMessages = map[string][2]interface{}{
+	TypeAnnounce:        {AnnounceMessage{}, AnnounceResponse{}},
+	TypeEnterRoom:       {EnterRoomMessage{}, EnterRoomResponse{}},
+	TypeExitRoom:        {ExitRoomMessage{}, ExitRoomResponse{}},
+	TypeOperations:      {OperationsMessage{}, OperationsResponse{}},
+	TypeState:           {StateMessage{}, nil},
+	TypeFetchOperations: {FetchOperationsMessage{}, FetchOperationsResponse{}},
+	TypeHistory:         {HistoryMessage{}, HistoryResponse{}},
+	TypeTimeline:        {TimelineMessage{}, TimelineResponse{}},
+}
+
+// serverMessages maps each [Server->Client] message type to its message.
+var serverMessages = map[string]interface{}{
+	TypeOperationsUpdate: OperationsUpdateMessage{},
+	TypeRequestState:     RequestStateMessage{},
+	TypeClearState:       ClearStateMessage{},
+	TypeNumMembersUpdate: NumMembersUpdateMessage{},
+	TypeOperationsChunk:  OperationsChunkMessage{},
+	TypeError:            ErrorMessage{},
+}
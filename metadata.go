@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"gopkg.in/yaml.v2"
+)
+
+// Metadata sources, selected with the METADATA_SOURCE env var
+const (
+	MetadataSourceFirestore = "firestore" // Firestore, with FIREBASE_CREDENTIALS_JSON
+	MetadataSourceEmulator  = "emulator"  // The Firestore emulator at FIRESTORE_EMULATOR_HOST
+	MetadataSourceFile      = "file"      // A JSON or YAML file of room definitions at ROOMS_FILE
+)
+
+// RoomMetadataSource provides the metadata of rooms, as described in docs/firestore_schema.md.
+type RoomMetadataSource interface {
+	// GetRoom retrieves a room's metadata, failing with ErrRoomNotFound if the room isn't defined.
+	GetRoom(roomName string) (bson.M, error)
+
+	// SetRoom creates or replaces a room's metadata.
+	SetRoom(roomName string, data bson.M) error
+}
+
+// UserDirectory provides the data kept per user.
+type UserDirectory interface {
+	// GetLastOperation retrieves when a user last submitted operations in a room, or 0 if they never have.
+	GetLastOperation(userID string, roomName string) (int64, error)
+
+	// SetLastOperation records when a user last submitted operations in a room.
+	SetLastOperation(userID string, roomName string, lastOperation int64) error
+
+	// DeleteAllUsers deletes all users. Be careful.
+	DeleteAllUsers() error
+}
+
+var (
+	// roomSource is the common reference to the room metadata source.
+	roomSource RoomMetadataSource
+
+	// userDirectory is the common reference to the user directory.
+	userDirectory UserDirectory
+)
+
+// loadMetadata connects to the room metadata source and user directory selected with the METADATA_SOURCE env var.
+func loadMetadata() {
+	source := os.Getenv("METADATA_SOURCE")
+	switch source {
+	case "", MetadataSourceFirestore:
+		fb := NewFirebase()
+		roomSource, userDirectory = fb, fb
+	case MetadataSourceEmulator:
+		fb := NewFirestoreEmulator()
+		roomSource, userDirectory = fb, fb
+	case MetadataSourceFile:
+		path := os.Getenv("ROOMS_FILE")
+		fileSource, err := NewFileRoomSource(path)
+		if err != nil {
+			log.Fatalf("unable to load ROOMS_FILE: %s", err)
+		}
+		roomSource, userDirectory = fileSource, NewMemoryUserDirectory()
+	default:
+		log.Fatalf("unknown METADATA_SOURCE \"%s\"", source)
+	}
+	log.Infof("using %T for room metadata and %T for users", roomSource, userDirectory)
+}
+
+// FileRoomSource serves room metadata from a JSON or YAML file mapping room names to their metadata.
+// Rooms set at runtime are kept in memory, the file is never written.
+type FileRoomSource struct {
+	sync.RWMutex
+	rooms map[string]bson.M
+}
+
+// NewFileRoomSource loads room metadata from a file, parsed as YAML if its extension is .yaml or .yml, or else JSON.
+func NewFileRoomSource(path string) (*FileRoomSource, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no rooms file given")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := make(map[string]bson.M)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var parsed map[string]interface{}
+		err = yaml.Unmarshal(b, &parsed)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+		}
+		for roomName, room := range parsed {
+			m, ok := yamlToJSON(room).(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("room %s in %s is not a mapping", roomName, path)
+			}
+			metadata[roomName] = m
+		}
+	default:
+		err = json.Unmarshal(b, &metadata)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+		}
+	}
+	log.Infof("loaded %d rooms from %s", len(metadata), path)
+	return &FileRoomSource{rooms: metadata}, nil
+}
+
+// yamlToJSON converts the maps YAML decodes to, which may have keys of any type, to maps with string keys.
+func yamlToJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			m[fmt.Sprint(k)] = yamlToJSON(elem)
+		}
+		return m
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = yamlToJSON(elem)
+		}
+		return v
+	}
+	return v
+}
+
+// GetRoom retrieves a room's metadata from the file.
+func (s *FileRoomSource) GetRoom(roomName string) (bson.M, error) {
+	s.RLock()
+	defer s.RUnlock()
+	room, ok := s.rooms[roomName]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrRoomNotFound, roomName)
+	}
+	return room, nil
+}
+
+// SetRoom creates or replaces a room's metadata in memory.
+func (s *FileRoomSource) SetRoom(roomName string, data bson.M) error {
+	s.Lock()
+	defer s.Unlock()
+	s.rooms[roomName] = data
+	return nil
+}
+
+// MemoryUserDirectory keeps user data in memory, for running without firestore.
+type MemoryUserDirectory struct {
+	sync.Mutex
+	lastOperations map[string]int64
+}
+
+// NewMemoryUserDirectory instantiates an empty MemoryUserDirectory.
+func NewMemoryUserDirectory() *MemoryUserDirectory {
+	return &MemoryUserDirectory{
+		lastOperations: make(map[string]int64),
+	}
+}
+
+// GetLastOperation retrieves when a user last submitted operations in a room, or 0 if they never have.
+func (d *MemoryUserDirectory) GetLastOperation(userID string, roomName string) (int64, error) {
+	d.Lock()
+	defer d.Unlock()
+	return d.lastOperations[actionKey(roomName, userID)], nil
+}
+
+// SetLastOperation records when a user last submitted operations in a room.
+func (d *MemoryUserDirectory) SetLastOperation(userID string, roomName string, lastOperation int64) error {
+	d.Lock()
+	defer d.Unlock()
+	d.lastOperations[actionKey(roomName, userID)] = lastOperation
+	return nil
+}
+
+// DeleteAllUsers forgets all user data.
+func (d *MemoryUserDirectory) DeleteAllUsers() error {
+	d.Lock()
+	defer d.Unlock()
+	d.lastOperations = make(map[string]int64)
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewFileRoomSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rooms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	jsonPath := filepath.Join(dir, "rooms.json")
+	err = ioutil.WriteFile(jsonPath, []byte(`{"test": {"type": "PIANO_ROLL_SEQUENCER", "actionsAllowed": 10, "actionWaitTime": 1000, "rules": "[{\"ruleType\": \"STEPS_DISABLED\", \"ruleParams\": {\"steps\": [15]}}, {\"ruleType\": \"KNOBS_MIN_MAX\", \"ruleParams\": {\"knobs\": [{\"id\": \"volume\", \"min\": 0, \"max\": 1}]}}]"}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// YAML and JSON files define rooms the same way
+	for _, path := range []string{"docs/rooms.example.yaml", jsonPath} {
+		t.Run(filepath.Ext(path), func(t *testing.T) {
+			source, err := NewFileRoomSource(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc, err := source.GetRoom("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			metadata := parseRoomMetadata("test", doc)
+			if metadata.Type != RoomTypePianoRollSequencer {
+				t.Errorf("got type %s, want %s", metadata.Type, RoomTypePianoRollSequencer)
+			}
+			if metadata.Limits.ActionsAllowed != 10 || metadata.Limits.ActionWaitTime != 1000 {
+				t.Errorf("got limits %+v, want 10 actions every 1000ms", metadata.Limits)
+			}
+			if len(metadata.Rules) != 2 {
+				t.Errorf("got %d rules, want 2", len(metadata.Rules))
+			}
+
+			if _, err := source.GetRoom("missing"); !errors.Is(err, ErrRoomNotFound) {
+				t.Errorf("got error %v for a missing room, want %v", err, ErrRoomNotFound)
+			}
+		})
+	}
+
+	if _, err := NewFileRoomSource(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("loaded a missing file")
+	}
+}
+
+func TestLoadMetadataFile(t *testing.T) {
+	defer func(source RoomMetadataSource, directory UserDirectory) {
+		roomSource, userDirectory = source, directory
+	}(roomSource, userDirectory)
+	defer os.Unsetenv("METADATA_SOURCE")
+	defer os.Unsetenv("ROOMS_FILE")
+	os.Setenv("METADATA_SOURCE", MetadataSourceFile)
+	os.Setenv("ROOMS_FILE", "docs/rooms.example.yaml")
+	rooms = NewRoomMap()
+	before := rooms
+
+	loadMetadata()
+	if _, ok := roomSource.(*FileRoomSource); !ok {
+		t.Errorf("got room source %T, want *FileRoomSource", roomSource)
+	}
+	if _, ok := userDirectory.(*MemoryUserDirectory); !ok {
+		t.Errorf("got user directory %T, want *MemoryUserDirectory", userDirectory)
+	}
+	if rooms != before {
+		t.Errorf("the room map was replaced")
+	}
+}
+
+func TestMemoryUserDirectory(t *testing.T) {
+	directory := NewMemoryUserDirectory()
+	directory.SetLastOperation("alice", "room", 1000)
+	if last, _ := directory.GetLastOperation("alice", "room"); last != 1000 {
+		t.Errorf("got last operation %d, want 1000", last)
+	}
+	if last, _ := directory.GetLastOperation("alice", "other"); last != 0 {
+		t.Errorf("got last operation %d in another room, want 0", last)
+	}
+	directory.DeleteAllUsers()
+	if last, _ := directory.GetLastOperation("alice", "room"); last != 0 {
+		t.Errorf("got last operation %d after deleting all users, want 0", last)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// Reasons a connection was reaped by the server
+const (
+	ReapPongTimeout  = "pongTimeout"  // No pong (or any message) before the read deadline
+	ReapIdleTimeout  = "idleTimeout"  // No client message within the idle timeout
+	ReapWriteTimeout = "writeTimeout" // A message could not be written before the write deadline
+)
+
+// metrics contains the server's connection counters.
+var metrics = &Metrics{}
+
+// Metrics counts connection lifecycle events since the server started.
+type Metrics struct {
+	connectionsOpened  int64
+	connectionsClosed  int64
+	reapedPongTimeout  int64
+	reapedIdleTimeout  int64
+	reapedWriteTimeout int64
+}
+
+// MetricsSnapshot is a point in time copy of the metrics, served at /admin/metrics.
+type MetricsSnapshot struct {
+	Connections       int64            `json:"connections"`
+	Users             int64            `json:"users"`
+	ConnectionsOpened int64            `json:"connectionsOpened"`
+	ConnectionsClosed int64            `json:"connectionsClosed"`
+	Reaped            map[string]int64 `json:"reaped"`
+
+	// Slow consumer policy counts by room name.
+	SlowConsumers map[string]map[string]int64 `json:"slowConsumers"`
+}
+
+// ConnectionOpened counts a new connection.
+func (m *Metrics) ConnectionOpened() {
+	atomic.AddInt64(&m.connectionsOpened, 1)
+}
+
+// ConnectionClosed counts a closed connection.
+func (m *Metrics) ConnectionClosed() {
+	atomic.AddInt64(&m.connectionsClosed, 1)
+}
+
+// ConnectionReaped counts a connection the server closed for one of the Reap* reasons.
+func (m *Metrics) ConnectionReaped(reason string) {
+	switch reason {
+	case ReapPongTimeout:
+		atomic.AddInt64(&m.reapedPongTimeout, 1)
+	case ReapIdleTimeout:
+		atomic.AddInt64(&m.reapedIdleTimeout, 1)
+	case ReapWriteTimeout:
+		atomic.AddInt64(&m.reapedWriteTimeout, 1)
+	}
+}
+
+// Snapshot returns the current value of the metrics.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	slowConsumers := make(map[string]map[string]int64)
+	rooms.Range(func(roomName string, room *Room) bool {
+		slowConsumers[roomName] = room.SlowConsumers.Snapshot()
+		return true
+	})
+	return MetricsSnapshot{
+		Connections:       int64(clients.Len()),
+		Users:             int64(users.Len()),
+		ConnectionsOpened: atomic.LoadInt64(&m.connectionsOpened),
+		ConnectionsClosed: atomic.LoadInt64(&m.connectionsClosed),
+		Reaped: map[string]int64{
+			ReapPongTimeout:  atomic.LoadInt64(&m.reapedPongTimeout),
+			ReapIdleTimeout:  atomic.LoadInt64(&m.reapedIdleTimeout),
+			ReapWriteTimeout: atomic.LoadInt64(&m.reapedWriteTimeout),
+		},
+		SlowConsumers: slowConsumers,
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Field types operation fields are validated and normalized as
+const (
+	FieldAny     = ""        // Any value
+	FieldString  = "string"  // A string
+	FieldNumber  = "number"  // Any number, normalized to a float64
+	FieldInteger = "integer" // A whole number, normalized to an int64
+	FieldBool    = "boolean" // A boolean
+	FieldObject  = "object"  // An object
+	FieldArray   = "array"   // An array
+)
+
+// FieldSchema describes a field of an operation or its payload.
+type FieldSchema struct {
+	Type     string
+	Required bool
+}
+
+// OperationSchema describes the operations committed in rooms of a type.
+type OperationSchema struct {
+	// Fields of every operation, besides those stamped by the server. Other fields are kept as is.
+	Fields map[string]FieldSchema
+
+	// Field holding the action type of an operation.
+	TypeField string
+
+	// Field holding the action payload of an operation.
+	PayloadField string
+
+	// Payload fields by action type. Operations with other action types are rejected.
+	Actions map[string]map[string]FieldSchema
+}
+
+// operationSchemas contains the registered operation schemas by room type.
+var (
+	operationSchemas      = make(map[string]*OperationSchema)
+	operationSchemasMutex sync.RWMutex
+)
+
+// RegisterOperationSchema registers the schema for operations in rooms of roomType, replacing any already registered.
+func RegisterOperationSchema(roomType string, schema *OperationSchema) {
+	operationSchemasMutex.Lock()
+	defer operationSchemasMutex.Unlock()
+	operationSchemas[roomType] = schema
+}
+
+// getOperationSchema returns the schema for operations in rooms of roomType, or nil if none is registered.
+func getOperationSchema(roomType string) *OperationSchema {
+	operationSchemasMutex.RLock()
+	defer operationSchemasMutex.RUnlock()
+	return operationSchemas[roomType]
+}
+
+// ValidateOperations validates operations against the schema for their room type, normalizing their fields in place.
+// Returns why each malformed operation is malformed. Rooms of types without a schema accept any operation.
+func ValidateOperations(roomType string, ops []bson.M) []RuleViolation {
+	invalid := []RuleViolation{}
+	schema := getOperationSchema(roomType)
+	if schema == nil {
+		return invalid
+	}
+	for i, op := range ops {
+		err := schema.Normalize(op)
+		if err != nil {
+			invalid = append(invalid, RuleViolation{Index: i, Reason: err.Error()})
+		}
+	}
+	return invalid
+}
+
+// Normalize validates an operation, converting its fields to their schema types in place.
+func (s *OperationSchema) Normalize(op bson.M) error {
+	err := normalizeFields(op, s.Fields, "")
+	if err != nil {
+		return err
+	}
+
+	actionType, _ := op[s.TypeField].(string)
+	fields, ok := s.Actions[actionType]
+	if !ok {
+		return fmt.Errorf("unknown %s \"%s\"", s.TypeField, actionType)
+	}
+	payload, ok := asMap(op[s.PayloadField])
+	if !ok {
+		return fmt.Errorf("%s must be an object", s.PayloadField)
+	}
+	return normalizeFields(payload, fields, s.PayloadField+".")
+}
+
+// normalizeFields validates the fields of an object, converting them to their schema types in place.
+// prefix is prepended to field names in errors.
+func normalizeFields(m map[string]interface{}, fields map[string]FieldSchema, prefix string) error {
+	for name, field := range fields {
+		v, ok := m[name]
+		if !ok || v == nil {
+			if field.Required {
+				return fmt.Errorf("missing %s%s", prefix, name)
+			}
+			continue
+		}
+		normalized, ok := normalizeField(v, field.Type)
+		if !ok {
+			return fmt.Errorf("%s%s must be of type %s, not %T", prefix, name, field.Type, v)
+		}
+		m[name] = normalized
+	}
+	return nil
+}
+
+// normalizeField converts a value however it was decoded to the canonical type for fieldType.
+// Returns false if the value isn't of fieldType.
+func normalizeField(v interface{}, fieldType string) (interface{}, bool) {
+	switch fieldType {
+	case FieldAny:
+		return v, true
+	case FieldString:
+		s, ok := v.(string)
+		return s, ok
+	case FieldNumber:
+		return toFloat(v)
+	case FieldInteger:
+		f, ok := toFloat(v)
+		if !ok || f != math.Trunc(f) {
+			return nil, false
+		}
+		return int64(f), true
+	case FieldBool:
+		b, ok := v.(bool)
+		return b, ok
+	case FieldObject:
+		m, ok := asMap(v)
+		return m, ok
+	case FieldArray:
+		a, ok := asArray(v)
+		return a, ok
+	}
+	return nil, false
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestOperationSchemaNormalize(t *testing.T) {
+	schema := &OperationSchema{
+		Fields: map[string]FieldSchema{
+			"type":      {Type: FieldString, Required: true},
+			"payload":   {Type: FieldObject, Required: true},
+			"timestamp": {Type: FieldInteger},
+		},
+		TypeField:    "type",
+		PayloadField: "payload",
+		Actions: map[string]map[string]FieldSchema{
+			"ADD_STEP": {
+				"stepNumber": {Type: FieldInteger, Required: true},
+				"resolution": {Type: FieldNumber},
+				"steps":      {Type: FieldArray},
+				"wrap":       {Type: FieldBool},
+				"note":       {Type: FieldAny},
+			},
+		},
+	}
+	addStep := func(payload bson.M) bson.M {
+		return bson.M{"type": "ADD_STEP", "payload": payload}
+	}
+
+	tests := []struct {
+		name    string
+		op      bson.M
+		err     string
+		payload bson.M // Normalized payload, if valid
+	}{
+		{"json numbers", addStep(bson.M{"stepNumber": 3.0, "resolution": 16.0}), "", bson.M{"stepNumber": int64(3), "resolution": 16.0}},
+		{"msgpack numbers", addStep(bson.M{"stepNumber": int8(3), "resolution": uint16(16)}), "", bson.M{"stepNumber": int64(3), "resolution": 16.0}},
+		{"bson numbers", addStep(bson.M{"stepNumber": int32(3), "resolution": int64(16)}), "", bson.M{"stepNumber": int64(3), "resolution": 16.0}},
+		{"arrays", addStep(bson.M{"stepNumber": 1, "steps": primitive.A{1, 2}}), "", bson.M{"stepNumber": int64(1), "steps": []interface{}{1, 2}}},
+		{"any and extra fields kept", addStep(bson.M{"stepNumber": 1, "note": "C4", "extra": true}), "", bson.M{"stepNumber": int64(1), "note": "C4", "extra": true}},
+		{"null optional field", addStep(bson.M{"stepNumber": 1, "wrap": nil}), "", bson.M{"stepNumber": int64(1), "wrap": nil}},
+		{"map payload", bson.M{"type": "ADD_STEP", "payload": map[string]interface{}{"stepNumber": 2.0}}, "", bson.M{"stepNumber": int64(2)}},
+		{"missing type", bson.M{"payload": bson.M{}}, "missing type", nil},
+		{"unknown type", bson.M{"type": "REMOVE_STEP", "payload": bson.M{}}, "unknown type \"REMOVE_STEP\"", nil},
+		{"missing payload", bson.M{"type": "ADD_STEP"}, "missing payload", nil},
+		{"payload not an object", bson.M{"type": "ADD_STEP", "payload": "step"}, "payload must be of type object, not string", nil},
+		{"missing payload field", addStep(bson.M{}), "missing payload.stepNumber", nil},
+		{"fractional integer", addStep(bson.M{"stepNumber": 1.5}), "payload.stepNumber must be of type integer, not float64", nil},
+		{"wrong type", addStep(bson.M{"stepNumber": 1, "wrap": "yes"}), "payload.wrap must be of type boolean, not string", nil},
+		{"wrong operation field type", bson.M{"type": "ADD_STEP", "payload": bson.M{"stepNumber": 1}, "timestamp": "now"}, "timestamp must be of type integer, not string", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := schema.Normalize(test.op)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Errorf("got error %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload, _ := asMap(test.op["payload"])
+			if len(payload) != len(test.payload) {
+				t.Errorf("got payload %v, want %v", payload, test.payload)
+			}
+			for name, want := range test.payload {
+				got := payload[name]
+				if a, ok := want.([]interface{}); ok {
+					if b, ok := got.([]interface{}); !ok || len(a) != len(b) {
+						t.Errorf("got payload.%s %#v, want %#v", name, got, want)
+					}
+					continue
+				}
+				if got != want {
+					t.Errorf("got payload.%s %#v, want %#v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateOperations(t *testing.T) {
+	ops := []bson.M{
+		{"type": "ADD_STEP", "payload": bson.M{"step": bson.M{}, "stepNumber": 1.0}},
+		{"type": "ADD_STEP", "payload": bson.M{}},
+	}
+	invalid := ValidateOperations(RoomTypePianoRollSequencer, ops)
+	if len(invalid) != 1 || invalid[0].Index != 1 {
+		t.Errorf("got violations %v, want only operation 1", invalid)
+	}
+	if len(ValidateOperations("", ops)) != 0 {
+		t.Errorf("rooms without a schema must accept any operation")
+	}
+}
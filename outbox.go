@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Slow consumer policies, selected with the SLOW_CONSUMER_POLICY env var
+const (
+	SlowConsumerDropOldest = "dropOldest" // Drop the oldest queued broadcast update, clients resync from gaps in seq
+	SlowConsumerCoalesce   = "coalesce"   // Merge operationsUpdate and numMembersUpdate messages, disconnecting if none can be
+	SlowConsumerDisconnect = "disconnect" // Disconnect the client, telling it to resync when it reconnects
+)
+
+// DefaultSendQueueSize is how many outbound messages may be queued per client before the slow consumer policy applies.
+const DefaultSendQueueSize = 256
+
+var (
+	sendQueueSize      = DefaultSendQueueSize
+	slowConsumerPolicy = SlowConsumerCoalesce
+)
+
+// loadSlowConsumerPolicy configures the outbound queues from the SEND_QUEUE_SIZE and SLOW_CONSUMER_POLICY env vars.
+func loadSlowConsumerPolicy() {
+	sendQueueSize = envInt("SEND_QUEUE_SIZE", DefaultSendQueueSize, 1)
+	switch policy := os.Getenv("SLOW_CONSUMER_POLICY"); policy {
+	case "":
+		slowConsumerPolicy = SlowConsumerCoalesce
+	case SlowConsumerDropOldest, SlowConsumerCoalesce, SlowConsumerDisconnect:
+		slowConsumerPolicy = policy
+	default:
+		log.Fatalf("unknown SLOW_CONSUMER_POLICY \"%s\"", policy)
+	}
+	log.Infof("send queue size %d, slow consumer policy: %s", sendQueueSize, slowConsumerPolicy)
+}
+
+// outbox is a bounded queue of outbound messages for a client, which never blocks the sender.
+type outbox struct {
+	sync.Mutex
+
+	// Queued messages, oldest first.
+	queue []interface{}
+
+	// Most messages queued before the policy applies.
+	size int
+
+	// Slow consumer policy.
+	policy string
+
+	// Signaled when messages are queued or the outbox is closed.
+	ready chan struct{}
+
+	// Flag for whether the outbox accepts more messages.
+	closed bool
+}
+
+// newOutbox creates an empty outbox.
+func newOutbox(size int, policy string) *outbox {
+	return &outbox{
+		queue:  []interface{}{},
+		size:   size,
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// Push queues a message, applying the slow consumer policy if the outbox is full.
+// Returns the policy applied, or "" if the message was queued normally.
+func (o *outbox) Push(m interface{}) (string, error) {
+	o.Lock()
+	defer o.Unlock()
+	if o.closed {
+		return "", fmt.Errorf("attempted send on closed send queue")
+	}
+	defer o.signal()
+
+	if len(o.queue) < o.size {
+		o.queue = append(o.queue, m)
+		return "", nil
+	}
+
+	switch o.policy {
+	case SlowConsumerDropOldest:
+		if o.dropOldest() {
+			o.queue = append(o.queue, m)
+			return SlowConsumerDropOldest, nil
+		}
+	case SlowConsumerCoalesce:
+		if o.coalesce(m) {
+			return SlowConsumerCoalesce, nil
+		}
+	}
+
+	// Replace everything queued with a hint to resync, then close
+	o.queue = []interface{}{
+		NewErrorMessage("", NewError(ErrCodeSlowConsumer, "", "too many messages queued, reconnect and enterRoom with sinceSeq of the last operation applied")),
+	}
+	o.closed = true
+	return SlowConsumerDisconnect, nil
+}
+
+// isBroadcastUpdate returns whether a message is an update broadcast to the members of a room, which clients can
+// recover from missing. Responses and the messages completing them must never be dropped.
+func isBroadcastUpdate(m interface{}) bool {
+	switch m.(type) {
+	case *OperationsUpdateMessage, *NumMembersUpdateMessage:
+		return true
+	}
+	return false
+}
+
+// dropOldest removes the oldest queued broadcast update, returning whether there was one.
+func (o *outbox) dropOldest() bool {
+	for i, queued := range o.queue {
+		if isBroadcastUpdate(queued) {
+			o.queue = append(o.queue[:i], o.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// coalesce merges an operationsUpdate message into the newest queued one, or replaces a queued numMembersUpdate
+// message with a newer one, returning whether it could.
+func (o *outbox) coalesce(m interface{}) bool {
+	if _, ok := m.(*NumMembersUpdateMessage); ok {
+		for i := len(o.queue) - 1; i >= 0; i-- {
+			if _, ok := o.queue[i].(*NumMembersUpdateMessage); ok {
+				o.queue[i] = m
+				return true
+			}
+		}
+		return false
+	}
+
+	update, ok := m.(*OperationsUpdateMessage)
+	if !ok {
+		return false
+	}
+	for i := len(o.queue) - 1; i >= 0; i-- {
+		queued, ok := o.queue[i].(*OperationsUpdateMessage)
+		if !ok {
+			continue
+		}
+
+		// Messages are shared between the members of a room, so merge into a copy
+		operations := make([]bson.M, 0, len(queued.Operations)+len(update.Operations))
+		operations = append(operations, queued.Operations...)
+		operations = append(operations, update.Operations...)
+		o.queue[i] = NewOperationsUpdateMessage(operations, update.MessageTime)
+		return true
+	}
+	return false
+}
+
+// Close stops the outbox accepting messages, the messages already queued can still be drained.
+func (o *outbox) Close() {
+	o.Lock()
+	defer o.Unlock()
+	if !o.closed {
+		o.closed = true
+		o.signal()
+	}
+}
+
+// Drain removes and returns all queued messages, and whether the outbox is closed.
+func (o *outbox) Drain() ([]interface{}, bool) {
+	o.Lock()
+	defer o.Unlock()
+	queue := o.queue
+	o.queue = []interface{}{}
+	return queue, o.closed
+}
+
+// Ready returns a channel that is signaled when there may be messages to drain.
+func (o *outbox) Ready() <-chan struct{} {
+	return o.ready
+}
+
+// signal wakes the writer without blocking, at most one signal is pending.
+func (o *outbox) signal() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// SlowConsumerCounters counts how often the slow consumer policy applied to the members of a room.
+type SlowConsumerCounters struct {
+	dropped      int64
+	coalesced    int64
+	disconnected int64
+}
+
+// Count counts a slow consumer policy being applied.
+func (s *SlowConsumerCounters) Count(policy string) {
+	switch policy {
+	case SlowConsumerDropOldest:
+		atomic.AddInt64(&s.dropped, 1)
+	case SlowConsumerCoalesce:
+		atomic.AddInt64(&s.coalesced, 1)
+	case SlowConsumerDisconnect:
+		atomic.AddInt64(&s.disconnected, 1)
+	}
+}
+
+// Snapshot returns the current counts by policy.
+func (s *SlowConsumerCounters) Snapshot() map[string]int64 {
+	return map[string]int64{
+		SlowConsumerDropOldest: atomic.LoadInt64(&s.dropped),
+		SlowConsumerCoalesce:   atomic.LoadInt64(&s.coalesced),
+		SlowConsumerDisconnect: atomic.LoadInt64(&s.disconnected),
+	}
+}
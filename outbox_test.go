@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestOutboxPush(t *testing.T) {
+	update := func(seq int64) *OperationsUpdateMessage {
+		return NewOperationsUpdateMessage([]bson.M{{OpKeySeq: seq}}, 0)
+	}
+	members := func(n int) *NumMembersUpdateMessage {
+		return &NumMembersUpdateMessage{Envelope: Envelope{Type: TypeNumMembersUpdate}, NumMembers: n}
+	}
+	response := func(id string) *OperationsResponse {
+		return &OperationsResponse{Response: Response{ID: id}}
+	}
+
+	tests := []struct {
+		name   string
+		policy string
+		queued []interface{}
+		push   interface{}
+		result string
+	}{
+		{"not full", SlowConsumerDisconnect, []interface{}{update(1)}, update(2), ""},
+		{"drop oldest update", SlowConsumerDropOldest, []interface{}{update(1), update(2)}, update(3), SlowConsumerDropOldest},
+		{"drop oldest keeps responses", SlowConsumerDropOldest, []interface{}{response("1"), update(2)}, response("3"), SlowConsumerDropOldest},
+		{"drop oldest without updates", SlowConsumerDropOldest, []interface{}{response("1"), response("2")}, update(3), SlowConsumerDisconnect},
+		{"coalesce updates", SlowConsumerCoalesce, []interface{}{update(1), response("2")}, update(3), SlowConsumerCoalesce},
+		{"coalesce num members", SlowConsumerCoalesce, []interface{}{members(1), response("2")}, members(3), SlowConsumerCoalesce},
+		{"coalesce response", SlowConsumerCoalesce, []interface{}{update(1), update(2)}, response("3"), SlowConsumerDisconnect},
+		{"disconnect", SlowConsumerDisconnect, []interface{}{update(1), update(2)}, update(3), SlowConsumerDisconnect},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := newOutbox(2, test.policy)
+			for _, m := range test.queued {
+				if _, err := o.Push(m); err != nil {
+					t.Fatal(err)
+				}
+			}
+			result, err := o.Push(test.push)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != test.result {
+				t.Errorf("got policy %q, want %q", result, test.result)
+			}
+
+			queue, closed := o.Drain()
+			if closed != (test.result == SlowConsumerDisconnect) {
+				t.Errorf("got closed %t after %q", closed, test.result)
+			}
+			switch test.result {
+			case SlowConsumerDisconnect:
+				if _, ok := queue[0].(*ErrorMessage); len(queue) != 1 || !ok {
+					t.Errorf("got queue %v, want only the resync hint", queue)
+				}
+			case SlowConsumerCoalesce:
+				if len(queue) != len(test.queued) {
+					t.Errorf("got %d queued messages, want %d", len(queue), len(test.queued))
+				}
+			case SlowConsumerDropOldest:
+				if len(queue) != len(test.queued) || queue[len(queue)-1] != test.push {
+					t.Errorf("got queue %v, want %v queued last", queue, test.push)
+				}
+			default:
+				if len(queue) != len(test.queued)+1 || queue[len(queue)-1] != test.push {
+					t.Errorf("got queue %v, want %v queued last", queue, test.push)
+				}
+			}
+
+			// Responses are only ever lost on disconnect
+			if test.result != SlowConsumerDisconnect {
+				for _, m := range append(test.queued, test.push) {
+					if isBroadcastUpdate(m) {
+						continue
+					}
+					found := false
+					for _, queued := range queue {
+						found = found || queued == m
+					}
+					if !found {
+						t.Errorf("response %v was dropped", m)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestOutboxCoalesceOperations(t *testing.T) {
+	o := newOutbox(1, SlowConsumerCoalesce)
+	first := NewOperationsUpdateMessage([]bson.M{{OpKeySeq: int64(1)}}, 0)
+	o.Push(first)
+	o.Push(NewOperationsUpdateMessage([]bson.M{{OpKeySeq: int64(2)}, {OpKeySeq: int64(3)}}, 0))
+
+	queue, _ := o.Drain()
+	merged, ok := queue[0].(*OperationsUpdateMessage)
+	if len(queue) != 1 || !ok {
+		t.Fatalf("got queue %v, want one operationsUpdate", queue)
+	}
+	for i, op := range merged.Operations {
+		if opSeq(op) != int64(i+1) {
+			t.Errorf("merged operation %d has seq %d, want %d", i, opSeq(op), i+1)
+		}
+	}
+	if len(merged.Operations) != 3 {
+		t.Errorf("got %d merged operations, want 3", len(merged.Operations))
+	}
+	if len(first.Operations) != 1 {
+		t.Errorf("merged into the queued message, which is shared with other members")
+	}
+}
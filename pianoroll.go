@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// RoomTypePianoRollSequencer is the type of rooms presenting the piano roll sequencer.
+const RoomTypePianoRollSequencer = "PIANO_ROLL_SEQUENCER"
+
+func init() {
+	RegisterOperationSchema(RoomTypePianoRollSequencer, pianoRollSequencerSchema)
+	RegisterFolder(RoomTypePianoRollSequencer, foldPianoRollSequencer)
+}
+
+// Payload fields shared by sequencer actions
+var (
+	trackField    = FieldSchema{Type: FieldInteger}
+	stepsField    = FieldSchema{Type: FieldArray, Required: true}
+	effectFields  = map[string]FieldSchema{"effect": {Required: true}, "track": trackField}
+	noFieldsKnown = map[string]FieldSchema{}
+)
+
+// pianoRollSequencerSchema describes the operations the sequencer client serializes, by action type.
+// Payload fields the client sends that aren't listed are kept as is.
+var pianoRollSequencerSchema = &OperationSchema{
+	Fields: map[string]FieldSchema{
+		"type":      {Type: FieldString, Required: true},
+		"payload":   {Type: FieldObject, Required: true},
+		"contentId": {Type: FieldAny},
+		OpKeyID:     {Type: FieldString},
+		"timestamp": {Type: FieldInteger},
+	},
+	TypeField:    "type",
+	PayloadField: "payload",
+	Actions: map[string]map[string]FieldSchema{
+		"ADD_STEP": {
+			"track":      trackField,
+			"step":       {Type: FieldObject, Required: true},
+			"stepNumber": {Type: FieldInteger, Required: true},
+			"resolution": {Type: FieldNumber},
+		},
+		"DELETE_STEP": {
+			"track":      trackField,
+			"step":       {Type: FieldObject, Required: true},
+			"stepNumber": {Type: FieldInteger, Required: true},
+			"resolution": {Type: FieldNumber},
+		},
+		"DELETE_STEP_NUMBER": {
+			"track":      trackField,
+			"stepNumber": {Type: FieldInteger, Required: true},
+			"resolution": {Type: FieldNumber},
+		},
+		"DELETE_STEPS": {
+			"track": trackField,
+			"steps": stepsField,
+		},
+		"MOVE_STEPS": {
+			"track":      trackField,
+			"steps":      {Type: FieldArray},
+			"wrap":       {Type: FieldBool},
+			"resolution": {Type: FieldNumber},
+		},
+		"SNAP_TO_GRID": {
+			"track":      trackField,
+			"steps":      {Type: FieldArray},
+			"resolution": {Type: FieldNumber},
+		},
+		"TOGGLE_STEP": {"track": trackField},
+		"RECORD_STEP": {"track": trackField},
+		"UPDATE_STEP_PARAMETER": {
+			"track":     trackField,
+			"parameter": {Required: true},
+		},
+		"UPDATE_PARAMETER": {
+			"parameter": {Required: true},
+		},
+		"ADD_EFFECT":    effectFields,
+		"DELETE_EFFECT": effectFields,
+		"TOGGLE_EFFECT": effectFields,
+		"MOVE_EFFECT": {
+			"from":         {Required: true},
+			"to":           {Required: true},
+			"isMidiEffect": {Type: FieldBool},
+			"track":        trackField,
+		},
+		"DELETE_PATTERN":                 noFieldsKnown,
+		"UPDATE_TRACK_MUTE":              {"track": trackField},
+		"UPDATE_TRACK_VOLUME":            {"track": trackField},
+		"ADD_AUTOMATION_BREAK_POINT":     noFieldsKnown,
+		"MOVE_AUTOMATION_BREAK_POINT":    noFieldsKnown,
+		"MOVE_AUTOMATION_BREAK_POINTS":   noFieldsKnown,
+		"REMOVE_AUTOMATION_BREAK_POINT":  noFieldsKnown,
+		"REMOVE_AUTOMATION_BREAK_POINTS": noFieldsKnown,
+	},
+}
+
+// pianoRollSetActions set a value outright, so a later action of the same type on the same content and track
+// supersedes an earlier one. The client coalesces consecutive ones the same way.
+var pianoRollSetActions = map[string]bool{
+	"UPDATE_PARAMETER":      true,
+	"UPDATE_STEP_PARAMETER": true,
+	"UPDATE_TRACK_VOLUME":   true,
+}
+
+// foldPianoRollSequencer folds sequencer operations into the state's operations, dropping those superseded by a
+// later operation that sets the same value.
+func foldPianoRollSequencer(state bson.M, ops []bson.M) bson.M {
+	folded := appendOperations(state, ops)
+	all := asOperations(folded[StateKeyOperations])
+
+	// Walk back from the latest operation, keeping the first of each value set
+	kept := make([]bson.M, 0, len(all))
+	set := make(map[string]bool)
+	for i := len(all) - 1; i >= 0; i-- {
+		if key, ok := pianoRollSetKey(all[i]); ok {
+			if set[key] {
+				continue
+			}
+			set[key] = true
+		}
+		kept = append(kept, all[i])
+	}
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+	folded[StateKeyOperations] = kept
+	return folded
+}
+
+// pianoRollSetKey returns the value an operation sets, and whether it sets one outright.
+func pianoRollSetKey(op bson.M) (string, bool) {
+	actionType, _ := op["type"].(string)
+	contentID, ok := op["contentId"]
+	if !pianoRollSetActions[actionType] || !ok || contentID == nil {
+		return "", false
+	}
+	payload, _ := asMap(op["payload"])
+	return fmt.Sprintf("%s|%v|%v|%v", actionType, contentID, payload["track"], payload["subSequence"]), true
+}
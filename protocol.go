@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Protocol versions. Clients that don't send a version on announce are LegacyProtocolVersion.
+const (
+	LegacyProtocolVersion = 1
+	AuthProtocolVersion   = 3 // Clients announce with an ID token
+	ProtocolVersion       = 3
+)
+
+// Capabilities the server and clients can advertise on announce
+const (
+	CapFetchOperations = "fetchOperations" // fetchOperations and enterRoom since cursors
+	CapSnapshots       = "snapshots"       // enterRoom may respond with a snapshot and the operations after it
+	CapPeerState       = "peerState"       // The client answers requestState with its full state
+	CapHistory         = "history"         // history and timeline messages
+	CapErrorCodes      = "errorCodes"      // Structured errors and the error message type
+
+	CapChunkedOperations = "chunkedOperations" // enterRoom operations may be split across operationsChunk messages
+	CapSessions          = "sessions"          // Sessions can be resumed with a session token after reconnecting
+)
+
+// serverCapabilities are the capabilities this server supports.
+var serverCapabilities = []string{
+	CapFetchOperations,
+	CapSnapshots,
+	CapPeerState,
+	CapHistory,
+	CapErrorCodes,
+	CapChunkedOperations,
+	CapSessions,
+}
+
+// minProtocolVersion is the oldest protocol version clients may announce with.
+// Clients that don't announce with an ID token are told to upgrade, unless MIN_PROTOCOL_VERSION allows them.
+var minProtocolVersion = AuthProtocolVersion
+
+// loadProtocol configures the oldest supported protocol version from the MIN_PROTOCOL_VERSION env var.
+func loadProtocol() {
+	if minEnv := os.Getenv("MIN_PROTOCOL_VERSION"); minEnv != "" {
+		v, err := strconv.Atoi(minEnv)
+		if err != nil || v < LegacyProtocolVersion || v > ProtocolVersion {
+			log.Fatalf("MIN_PROTOCOL_VERSION \"%s\" must be between %d and %d", minEnv, LegacyProtocolVersion, ProtocolVersion)
+		}
+		minProtocolVersion = v
+	}
+	log.Infof("protocol version %d (minimum %d)", ProtocolVersion, minProtocolVersion)
+	if minProtocolVersion < AuthProtocolVersion {
+		log.Warnf("clients announcing with protocol versions before %d are not authenticated", AuthProtocolVersion)
+	}
+}
+
+// negotiateProtocol returns the protocol version to use with a client announcing clientVersion,
+// and whether the client must upgrade to be served.
+func negotiateProtocol(clientVersion int) (int, bool) {
+	if clientVersion <= 0 {
+		clientVersion = LegacyProtocolVersion
+	}
+	if clientVersion < minProtocolVersion {
+		return clientVersion, true
+	}
+	if clientVersion > ProtocolVersion {
+		return ProtocolVersion, false
+	}
+	return clientVersion, false
+}
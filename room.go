@@ -3,7 +3,12 @@ package main
 // Adapted from https://gitRoom.com/gorilla/websocket/tree/master/examples/chat
 
 import (
+	"fmt"
+	"sync"
+	"time"
+
 	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 // rooms contain all the existing rooms
@@ -19,9 +24,74 @@ type Room struct {
 
 	// NeedsState contains clients that need the most recent state.
 	NeedsState *ClientMap
+
+	// SlowConsumers counts how often members fell behind on messages.
+	SlowConsumers SlowConsumerCounters
+
+	// metadata caches what the server enforces from the room's firestore document.
+	metadata      *RoomMetadata
+	metadataMutex sync.Mutex
+}
+
+// RoomMetadataTTL is how long a room's metadata is cached before it is reloaded.
+const RoomMetadataTTL = time.Minute
+
+// RoomMetadata is what the server enforces from a room's firestore document.
+type RoomMetadata struct {
+	// Type of interface the room presents, which selects the operation schema.
+	Type string
+
+	// Limits on how many operations a user submits, and how often.
+	Limits ActionLimits
+
+	// Rules operations must follow.
+	Rules []*Rule
+
+	loadedAt time.Time
 }
 
-// Broadcast sends a message to all connected members, except those passed in to ignore.
+// parseRoomMetadata reads the enforced fields of a firestore room document.
+func parseRoomMetadata(roomName string, doc bson.M) *RoomMetadata {
+	rules, err := ParseRules(doc["rules"])
+	if err != nil {
+		log.Errorf("unable to parse rules for room %s, not enforcing them: %s", roomName, err)
+	}
+	roomType, _ := doc["type"].(string)
+	return &RoomMetadata{
+		Type:     roomType,
+		Limits:   parseActionLimits(doc),
+		Rules:    rules,
+		loadedAt: time.Now(),
+	}
+}
+
+// Metadata returns the room's metadata, reloading it from the metadata source when it is stale.
+func (r *Room) Metadata() *RoomMetadata {
+	r.metadataMutex.Lock()
+	defer r.metadataMutex.Unlock()
+	if r.metadata != nil && time.Since(r.metadata.loadedAt) < RoomMetadataTTL {
+		return r.metadata
+	}
+	if roomSource == nil {
+		return &RoomMetadata{}
+	}
+
+	doc, err := roomSource.GetRoom(r.RoomName)
+	if err != nil {
+		log.Errorf("unable to load metadata for room %s: %s", r.RoomName, err)
+		if r.metadata == nil {
+			// Don't enforce anything until the metadata source can be reached, the browser still does
+			r.metadata = &RoomMetadata{}
+		}
+		r.metadata.loadedAt = time.Now()
+		return r.metadata
+	}
+	r.metadata = parseRoomMetadata(r.RoomName, doc)
+	return r.metadata
+}
+
+// Broadcast queues a message for all connected members, except those passed in to ignore, without blocking on slow
+// members.
 func (r *Room) Broadcast(m interface{}, ignoreClients ...*Client) {
 	f := func(c *Client, v bool) bool {
 		ignore := false
@@ -41,3 +111,13 @@ func (r *Room) Broadcast(m interface{}, ignoreClients ...*Client) {
 	}
 	r.Members.Range(f)
 }
+
+// ClearRoomState tells all members of a room to clear their state.
+func ClearRoomState(roomName string) error {
+	room, ok := rooms.Get(roomName)
+	if !ok {
+		return fmt.Errorf("server is not tracking room %s, but its operations have been deleted", roomName)
+	}
+	room.Broadcast(NewClearStateMessage())
+	return nil
+}
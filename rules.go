@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Rule types, see docs/firestore_schema.md
+const (
+	RuleStepsDisabled = "STEPS_DISABLED"
+	RuleNotesDisabled = "NOTES_DISABLED"
+	RuleKnobsDisabled = "KNOBS_DISABLED"
+	RuleKnobsMinMax   = "KNOBS_MIN_MAX"
+)
+
+// Operation fields the rules inspect, dotted paths into the operation that traverse arrays
+var (
+	stepFields    = []string{"payload.stepNumber", "payload.step.stepNumber", "payload.steps.stepNumber"}
+	noteFields    = []string{"payload.note", "payload.step.note", "payload.steps.note"}
+	knobFields    = []string{"payload.knob", "payload.parameter"}
+	payloadFields = []string{"payload"}
+)
+
+// RuleViolation describes an operation that broke, or was adjusted to follow, a room rule or operation schema.
+type RuleViolation struct {
+	Index     int    `json:"index"`               // Index of the operation in the submission
+	RuleType  string `json:"ruleType,omitempty"`  // Type of the rule, unset for schema violations
+	Reason    string `json:"reason"`              // Human-readable reason
+	Operation bson.M `json:"operation,omitempty"` // The operation as committed, for adjustments
+}
+
+// knobRange is the range of values a KNOBS_MIN_MAX rule allows for a knob.
+type knobRange struct {
+	ID  string  `json:"id"`
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// ruleParams are the parameters of any rule type, only those for the rule's type are set.
+type ruleParams struct {
+	Steps      []int64     // STEPS_DISABLED
+	Notes      []string    // NOTES_DISABLED
+	Knobs      []string    // KNOBS_DISABLED
+	KnobRanges []knobRange // KNOBS_MIN_MAX
+}
+
+// Rule is a parsed room rule.
+// Rules with a ruleFunction change their params over time. The server can't run the function, so it only enforces
+// them if their ruleParams also declare a schedule: a list of ruleParams, each in effect for ruleFunctionInterval
+// milliseconds in turn.
+type Rule struct {
+	Type string
+
+	// Params in effect at all times, for rules without a ruleFunction.
+	params *ruleParams
+
+	// Params in effect in turn for interval milliseconds each, for rules with a ruleFunction.
+	schedule []*ruleParams
+	interval int64
+}
+
+// ParseRules parses a room's rules, a JSON string as stored in firestore.
+// Rules of unknown types, and time-varying rules without a schedule, are skipped.
+func ParseRules(v interface{}) ([]*Rule, error) {
+	rules := []*Rule{}
+	s, _ := v.(string)
+	if s == "" {
+		return rules, nil
+	}
+
+	var raw []struct {
+		RuleType     string          `json:"ruleType"`
+		RuleParams   json.RawMessage `json:"ruleParams"`
+		RuleFunction string          `json:"ruleFunction"`
+	}
+	err := json.Unmarshal([]byte(s), &raw)
+	if err != nil {
+		return rules, fmt.Errorf("unable to parse rules: %w", err)
+	}
+
+	for i, r := range raw {
+		switch r.RuleType {
+		case RuleStepsDisabled, RuleNotesDisabled, RuleKnobsDisabled, RuleKnobsMinMax:
+		default:
+			continue
+		}
+		rule := &Rule{Type: r.RuleType}
+		if r.RuleFunction == "" {
+			rule.params, err = parseRuleParams(r.RuleType, r.RuleParams)
+			if err != nil {
+				return rules, fmt.Errorf("unable to parse ruleParams of rule %d: %w", i, err)
+			}
+			rules = append(rules, rule)
+			continue
+		}
+
+		var scheduled struct {
+			RuleFunctionInterval int64             `json:"ruleFunctionInterval"`
+			Schedule             []json.RawMessage `json:"schedule"`
+		}
+		err = json.Unmarshal(unwrapJSONString(r.RuleParams), &scheduled)
+		if err != nil {
+			return rules, fmt.Errorf("unable to parse ruleParams of rule %d: %w", i, err)
+		}
+		if len(scheduled.Schedule) == 0 || scheduled.RuleFunctionInterval <= 0 {
+			continue
+		}
+		rule.interval = scheduled.RuleFunctionInterval
+		for _, entry := range scheduled.Schedule {
+			params, err := parseRuleParams(r.RuleType, entry)
+			if err != nil {
+				return rules, fmt.Errorf("unable to parse schedule of rule %d: %w", i, err)
+			}
+			rule.schedule = append(rule.schedule, params)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// unwrapJSONString returns the JSON in a JSON string, or b as is if it isn't a string. Missing JSON is an empty object.
+func unwrapJSONString(b json.RawMessage) json.RawMessage {
+	if len(b) == 0 {
+		return json.RawMessage("{}")
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return b
+	}
+	if s == "" {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(s)
+}
+
+// parseRuleParams parses the params of a rule of ruleType.
+func parseRuleParams(ruleType string, b json.RawMessage) (*ruleParams, error) {
+	b = unwrapJSONString(b)
+	params := &ruleParams{}
+	var err error
+	switch ruleType {
+	case RuleStepsDisabled:
+		var p struct {
+			Steps []int64 `json:"steps"`
+		}
+		err = json.Unmarshal(b, &p)
+		params.Steps = p.Steps
+	case RuleNotesDisabled:
+		var p struct {
+			Notes []string `json:"notes"`
+		}
+		err = json.Unmarshal(b, &p)
+		params.Notes = p.Notes
+	case RuleKnobsDisabled:
+		var p struct {
+			Knobs []string `json:"knobs"`
+		}
+		err = json.Unmarshal(b, &p)
+		params.Knobs = p.Knobs
+	case RuleKnobsMinMax:
+		var p struct {
+			Knobs []knobRange `json:"knobs"`
+		}
+		err = json.Unmarshal(b, &p)
+		params.KnobRanges = p.Knobs
+	}
+	if err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// paramsAt returns the rule's params in effect at t (milliseconds).
+func (r *Rule) paramsAt(t int64) *ruleParams {
+	if len(r.schedule) == 0 {
+		return r.params
+	}
+	return r.schedule[(t/r.interval)%int64(len(r.schedule))]
+}
+
+// Apply checks an operation against the rule at t (milliseconds), clamping values into range where the rule allows.
+// Returns the reason the operation violates the rule, and the reason it was adjusted, "" if it wasn't.
+func (r *Rule) Apply(op bson.M, t int64) (string, string) {
+	params := r.paramsAt(t)
+	switch r.Type {
+	case RuleStepsDisabled:
+		for _, v := range fieldValues(op, stepFields) {
+			step, ok := toFloat(v)
+			if !ok {
+				continue
+			}
+			for _, disabled := range params.Steps {
+				if int64(step) == disabled {
+					return fmt.Sprintf("step %d is disabled", disabled), ""
+				}
+			}
+		}
+	case RuleNotesDisabled:
+		for _, v := range fieldValues(op, noteFields) {
+			note, _ := v.(string)
+			for _, disabled := range params.Notes {
+				if note != "" && strings.EqualFold(note, disabled) {
+					return fmt.Sprintf("note %s is disabled", disabled), ""
+				}
+			}
+		}
+	case RuleKnobsDisabled:
+		for _, v := range fieldValues(op, knobFields) {
+			knob, _ := v.(string)
+			for _, disabled := range params.Knobs {
+				if knob != "" && knob == disabled {
+					return fmt.Sprintf("knob %s is disabled", disabled), ""
+				}
+			}
+		}
+	case RuleKnobsMinMax:
+		// Values are clamped in the payload they were read from, the payload may be an array of them
+		adjusted := []string{}
+		for _, v := range fieldValues(op, payloadFields) {
+			payload, ok := asMap(v)
+			if !ok {
+				continue
+			}
+			knob, _ := payload["knob"].(string)
+			if knob == "" {
+				knob, _ = payload["parameter"].(string)
+			}
+			value, ok := payload["value"]
+			if knob == "" || !ok {
+				continue
+			}
+			for _, knobRange := range params.KnobRanges {
+				if knob != knobRange.ID {
+					continue
+				}
+				f, ok := toFloat(value)
+				if !ok {
+					return fmt.Sprintf("knob %s value %v is not a number", knob, value), ""
+				}
+				clamped := f
+				if clamped < knobRange.Min {
+					clamped = knobRange.Min
+				}
+				if clamped > knobRange.Max {
+					clamped = knobRange.Max
+				}
+				if clamped != f {
+					payload["value"] = clamped
+					adjusted = append(adjusted, fmt.Sprintf("knob %s value %v clamped to %v", knob, f, clamped))
+				}
+			}
+		}
+		return "", strings.Join(adjusted, ", ")
+	}
+	return "", ""
+}
+
+// ApplyRules checks operations against a room's rules at t (milliseconds), clamping values into range where a rule
+// allows. Returns the violations, and the adjustments made to operations that follow the rules once clamped.
+func ApplyRules(rules []*Rule, ops []bson.M, t int64) ([]RuleViolation, []RuleViolation) {
+	violations := []RuleViolation{}
+	adjustments := []RuleViolation{}
+	for i, op := range ops {
+		for _, rule := range rules {
+			violation, adjustment := rule.Apply(op, t)
+			if violation != "" {
+				violations = append(violations, RuleViolation{Index: i, RuleType: rule.Type, Reason: violation})
+			}
+			if adjustment != "" {
+				adjustments = append(adjustments, RuleViolation{Index: i, RuleType: rule.Type, Reason: adjustment, Operation: op})
+			}
+		}
+	}
+	return violations, adjustments
+}
+
+// fieldValues returns the values at dotted paths in v, traversing into every element of arrays along the way.
+func fieldValues(v interface{}, paths []string) []interface{} {
+	values := []interface{}{}
+	for _, path := range paths {
+		values = appendFieldValues(values, v, strings.Split(path, "."))
+	}
+	return values
+}
+
+// appendFieldValues appends the values at path in v to values.
+func appendFieldValues(values []interface{}, v interface{}, path []string) []interface{} {
+	if arr, ok := asArray(v); ok {
+		for _, elem := range arr {
+			values = appendFieldValues(values, elem, path)
+		}
+		return values
+	}
+	if len(path) == 0 {
+		return append(values, v)
+	}
+	m, ok := asMap(v)
+	if !ok {
+		return values
+	}
+	child, ok := m[path[0]]
+	if !ok {
+		return values
+	}
+	return appendFieldValues(values, child, path[1:])
+}
+
+// asMap returns v as a map, however it was decoded.
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case bson.M:
+		return m, true
+	case map[string]interface{}:
+		return m, true
+	}
+	return nil, false
+}
+
+// asArray returns v as a slice, however it was decoded.
+func asArray(v interface{}) ([]interface{}, bool) {
+	switch a := v.(type) {
+	case primitive.A:
+		return a, true
+	case []interface{}:
+		return a, true
+	}
+	return nil, false
+}
+
+// toFloat returns a number however it was decoded as a float64, and whether v is a number.
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int, int8, int16, int32, int64, uint8, uint16, uint32, uint64:
+		return float64(opInt(bson.M{"n": n}, "n")), true
+	}
+	return 0, false
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules interface{}
+		types []string
+		err   bool
+	}{
+		{"unset", nil, []string{}, false},
+		{"empty", "", []string{}, false},
+		{"invalid", "not json", []string{}, true},
+		{"params as object", `[{"ruleType":"STEPS_DISABLED","ruleParams":{"steps":[1,2]}}]`, []string{RuleStepsDisabled}, false},
+		{"params as string", `[{"ruleType":"NOTES_DISABLED","ruleParams":"{\"notes\":[\"C4\"]}"}]`, []string{RuleNotesDisabled}, false},
+		{"unknown type", `[{"ruleType":"NOTHING","ruleParams":{}},{"ruleType":"KNOBS_DISABLED","ruleParams":{"knobs":["cutoff"]}}]`, []string{RuleKnobsDisabled}, false},
+		{"function without schedule", `[{"ruleType":"STEPS_DISABLED","ruleParams":{"steps":[1]},"ruleFunction":"f"}]`, []string{}, false},
+		{"function with schedule", `[{"ruleType":"STEPS_DISABLED","ruleParams":{"ruleFunctionInterval":1000,"schedule":[{"steps":[1]},{"steps":[2]}]},"ruleFunction":"f"}]`, []string{RuleStepsDisabled}, false},
+		{"invalid params", `[{"ruleType":"STEPS_DISABLED","ruleParams":{"steps":"all"}}]`, []string{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules, err := ParseRules(test.rules)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if len(rules) != len(test.types) {
+				t.Fatalf("got %d rules, want %d", len(rules), len(test.types))
+			}
+			for i, rule := range rules {
+				if rule.Type != test.types[i] {
+					t.Errorf("rule %d has type %s, want %s", i, rule.Type, test.types[i])
+				}
+			}
+		})
+	}
+}
+
+func TestApplyRules(t *testing.T) {
+	const rules = `[
+		{"ruleType":"STEPS_DISABLED","ruleParams":{"ruleFunctionInterval":1000,"schedule":[{"steps":[1]},{"steps":[2]}]},"ruleFunction":"f"},
+		{"ruleType":"NOTES_DISABLED","ruleParams":{"notes":["C4"]}},
+		{"ruleType":"KNOBS_DISABLED","ruleParams":{"knobs":["cutoff"]}},
+		{"ruleType":"KNOBS_MIN_MAX","ruleParams":{"knobs":[{"id":"volume","min":0,"max":1}]}}
+	]`
+	parsed, err := ParseRules(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		op          bson.M
+		t           int64
+		violations  int
+		adjustments int
+		value       interface{} // The value at payload.value, or payload.0.value for array payloads, after applying
+	}{
+		{"no payload", bson.M{"type": "START"}, 0, 0, 0, nil},
+		{"allowed step", bson.M{"payload": bson.M{"stepNumber": 2}}, 0, 0, 0, nil},
+		{"scheduled step disabled", bson.M{"payload": bson.M{"stepNumber": 1}}, 500, 1, 0, nil},
+		{"scheduled step enabled later", bson.M{"payload": bson.M{"stepNumber": 1}}, 1500, 0, 0, nil},
+		{"scheduled step wraps around", bson.M{"payload": bson.M{"stepNumber": 1}}, 2500, 1, 0, nil},
+		{"steps array", bson.M{"payload": bson.M{"steps": primitive.A{bson.M{"stepNumber": 3}, bson.M{"stepNumber": 2}}}}, 1000, 1, 0, nil},
+		{"note disabled", bson.M{"payload": bson.M{"step": bson.M{"note": "c4"}}}, 0, 1, 0, nil},
+		{"knob disabled", bson.M{"payload": bson.M{"parameter": "cutoff"}}, 0, 1, 0, nil},
+		{"knob in range", bson.M{"payload": bson.M{"knob": "volume", "value": 0.5}}, 0, 0, 0, 0.5},
+		{"knob clamped", bson.M{"payload": bson.M{"knob": "volume", "value": 5}}, 0, 0, 1, 1.0},
+		{"knob not a number", bson.M{"payload": bson.M{"knob": "volume", "value": "loud"}}, 0, 1, 0, "loud"},
+		{"array payload clamped", bson.M{"payload": primitive.A{bson.M{"knob": "volume", "value": 5}}}, 0, 0, 1, 1.0},
+		{"array payload of scalars", bson.M{"payload": []interface{}{"volume", 5}}, 0, 0, 0, nil},
+		{"array payload of other knobs", bson.M{"payload": []interface{}{bson.M{"knob": "pan", "value": 5}, bson.M{"knob": "volume", "value": -1}}}, 0, 0, 1, 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			violations, adjustments := ApplyRules(parsed, []bson.M{test.op}, test.t)
+			if len(violations) != test.violations {
+				t.Errorf("got violations %v, want %d", violations, test.violations)
+			}
+			if len(adjustments) != test.adjustments {
+				t.Errorf("got adjustments %v, want %d", adjustments, test.adjustments)
+			}
+			if test.value == nil {
+				return
+			}
+			payload, ok := asMap(test.op["payload"])
+			if !ok {
+				arr, _ := asArray(test.op["payload"])
+				payload, _ = asMap(arr[0])
+			}
+			if payload["value"] != test.value {
+				t.Errorf("got value %v, want %v", payload["value"], test.value)
+			}
+		})
+	}
+}
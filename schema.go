@@ -0,0 +1,151 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SchemaVersion is the JSON Schema draft the protocol schema is written against.
+const SchemaVersion = "http://json-schema.org/draft-07/schema#"
+
+var (
+	objectIDType = reflect.TypeOf(primitive.ObjectID{})
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// GenerateSchema returns a JSON Schema describing every websocket message, generated from the message structs.
+// clientMessages, responses and serverMessages map message types to their definitions.
+func GenerateSchema() map[string]interface{} {
+	definitions := map[string]interface{}{}
+	clientRefs := map[string]interface{}{}
+	responseRefs := map[string]interface{}{}
+	serverRefs := map[string]interface{}{}
+
+	for msgType, pair := range clientMessages {
+		clientRefs[msgType] = messageSchema(msgType, pair[0], definitions)
+		if pair[1] != nil {
+			responseRefs[msgType] = schemaFor(reflect.TypeOf(pair[1]), definitions)
+		}
+	}
+	for msgType, m := range serverMessages {
+		serverRefs[msgType] = messageSchema(msgType, m, definitions)
+	}
+
+	return map[string]interface{}{
+		"$schema":        SchemaVersion,
+		"title":          "nime2020 websocket protocol",
+		"definitions":    definitions,
+		"clientMessages": clientRefs,
+		"responses":      responseRefs,
+		"serverMessages": serverRefs,
+	}
+}
+
+// messageSchema returns a reference to the definition of a message, pinning its type property to msgType.
+func messageSchema(msgType string, m interface{}, definitions map[string]interface{}) map[string]interface{} {
+	t := reflect.TypeOf(m)
+	ref := schemaFor(t, definitions)
+	if def, ok := definitions[t.Name()].(map[string]interface{}); ok {
+		properties := def["properties"].(map[string]interface{})
+		properties["type"] = map[string]interface{}{
+			"type":  "string",
+			"const": msgType,
+		}
+	}
+	return ref
+}
+
+// schemaFor returns the schema for a Go type, adding named structs to definitions and returning a reference to them.
+func schemaFor(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t {
+	case objectIDType:
+		return map[string]interface{}{"type": "string"}
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": schemaFor(t.Elem(), definitions),
+		}
+	case reflect.Map:
+		schema := map[string]interface{}{"type": "object"}
+		if t.Elem().Kind() != reflect.Interface {
+			schema["additionalProperties"] = schemaFor(t.Elem(), definitions)
+		}
+		return schema
+	case reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+		if _, ok := definitions[t.Name()]; ok {
+			return ref
+		}
+		def := map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{},
+		}
+		definitions[t.Name()] = def // Before fields, in case of recursive types
+		required := []string{}
+		addStructFields(t, def["properties"].(map[string]interface{}), &required, definitions)
+		if len(required) > 0 {
+			def["required"] = required
+		}
+		return ref
+	}
+	return map[string]interface{}{}
+}
+
+// addStructFields adds the JSON fields of a struct to properties, inlining embedded structs as encoding/json does.
+func addStructFields(t reflect.Type, properties map[string]interface{}, required *[]string, definitions map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue // Unexported
+		}
+
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := field.Name
+		omitempty := false
+		if tag != "" {
+			parts := strings.Split(tag, ",")
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			for _, opt := range parts[1:] {
+				if opt == "omitempty" {
+					omitempty = true
+				}
+			}
+		}
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct && tag == "" {
+			addStructFields(field.Type, properties, required, definitions)
+			continue
+		}
+
+		properties[name] = schemaFor(field.Type, definitions)
+		if !omitempty {
+			*required = append(*required, name)
+		}
+	}
+}
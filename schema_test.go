@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestGenerateSchema(t *testing.T) {
+	schema := GenerateSchema()
+
+	// The schema must be valid JSON
+	if _, err := json.Marshal(schema); err != nil {
+		t.Fatal(err)
+	}
+
+	clientRefs := schema["clientMessages"].(map[string]interface{})
+	serverRefs := schema["serverMessages"].(map[string]interface{})
+	for msgType := range clientMessages {
+		if _, ok := clientRefs[msgType]; !ok {
+			t.Errorf("client message %s missing from schema", msgType)
+		}
+	}
+	for msgType := range serverMessages {
+		if _, ok := serverRefs[msgType]; !ok {
+			t.Errorf("server message %s missing from schema", msgType)
+		}
+	}
+
+	definitions := schema["definitions"].(map[string]interface{})
+	enterRoom := definitions["EnterRoomMessage"].(map[string]interface{})
+	properties := enterRoom["properties"].(map[string]interface{})
+
+	// Message types are pinned, and embedded fields are inlined
+	msgType := properties["type"].(map[string]interface{})
+	if msgType["const"] != TypeEnterRoom {
+		t.Errorf("got type %v, want %s", msgType["const"], TypeEnterRoom)
+	}
+	for _, name := range []string{"id", "roomName", "sinceSeq", "sinceBucket"} {
+		if _, ok := properties[name]; !ok {
+			t.Errorf("EnterRoomMessage is missing property %s", name)
+		}
+	}
+
+	// Only fields that are always present are required
+	required := map[string]bool{}
+	for _, name := range enterRoom["required"].([]string) {
+		required[name] = true
+	}
+	if !required["type"] || !required["roomName"] || required["id"] || required["sinceSeq"] {
+		t.Errorf("got required %v, want type and roomName", enterRoom["required"])
+	}
+}
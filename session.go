@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// DefaultSessionGracePeriod is how long a dropped client's session is held for it to resume.
+const DefaultSessionGracePeriod = 30 * time.Second
+
+// sessionGracePeriod is configured with the SESSION_GRACE_PERIOD env var (milliseconds), 0 disables resuming.
+var sessionGracePeriod = DefaultSessionGracePeriod
+
+// sessions contains the clients with a session token, connected or detached within the grace period.
+var sessions = NewSessionMap()
+
+// loadSessions configures how long sessions are held from the SESSION_GRACE_PERIOD env var.
+func loadSessions() {
+	sessionGracePeriod = envMillis("SESSION_GRACE_PERIOD", DefaultSessionGracePeriod, 0)
+	log.Infof("session grace period %s", sessionGracePeriod)
+}
+
+// SessionMap is a concurrency-safe map of session tokens to clients.
+type SessionMap struct {
+	sync.Mutex
+	m map[string]*Client
+}
+
+// NewSessionMap instantiates a SessionMap.
+func NewSessionMap() *SessionMap {
+	return &SessionMap{
+		m: make(map[string]*Client),
+	}
+}
+
+// Set sets a value in the map.
+func (s *SessionMap) Set(k string, v *Client) {
+	s.Lock()
+	s.m[k] = v
+	s.Unlock()
+}
+
+// Take deletes and returns the client for a token if it is c, or any client if c is nil.
+// Only one of a resume and an expiry can take a detached session.
+func (s *SessionMap) Take(k string, c *Client) (*Client, bool) {
+	s.Lock()
+	defer s.Unlock()
+	v, ok := s.m[k]
+	if !ok || (c != nil && v != c) {
+		return nil, false
+	}
+	delete(s.m, k)
+	return v, true
+}
+
+// ensureSession issues the client a session token if it doesn't have one.
+func (c *Client) ensureSession() string {
+	if c.sessionToken == "" {
+		c.sessionToken = uuid.New().String()
+		sessions.Set(c.sessionToken, c)
+	}
+	return c.sessionToken
+}
+
+// isDetached returns whether the client's connection dropped and its session is waiting to be resumed.
+func (c *Client) isDetached() bool {
+	return atomic.LoadInt32(&c.detached) == 1
+}
+
+// detach holds the session of a client whose connection dropped, keeping it a member of its room for the grace
+// period. Returns false if the session can't be held.
+func (c *Client) detach() bool {
+	if sessionGracePeriod <= 0 || c.sessionToken == "" || c.Room == nil || c.isTakenOver() {
+		return false
+	}
+	atomic.StoreInt32(&c.detached, 1)
+	log.Infof("holding session for user \"%s\" in room %s for %s", c.UserID, c.Room.RoomName, sessionGracePeriod)
+	time.AfterFunc(sessionGracePeriod, func() {
+		if _, ok := sessions.Take(c.sessionToken, c); ok {
+			log.Infof("session for user \"%s\" expired", c.UserID)
+			c.leaveRoom()
+		}
+	})
+	return true
+}
+
+// resumeSession reattaches the detached session for token to c, moving its room membership to c without changing
+// num_members, and returns the operations committed in the room since sinceSeq to replay.
+// Returns false if there is no such session, or the operations can no longer be replayed.
+func resumeSession(c *Client, token string, userID string, sinceSeq int64, sinceBucket int) ([]bson.M, bool) {
+	old, ok := sessions.Take(token, nil)
+	if !ok {
+		return nil, false
+	}
+	if !old.isDetached() || old.UserID != userID {
+		// Still connected, or someone else's session
+		sessions.Set(token, old)
+		return nil, false
+	}
+
+	// Replace the old client in the room before reading the operations to replay, so any committed meanwhile are
+	// broadcast to c if they aren't read. The client skips operations by seq if it gets them twice.
+	room := old.Room
+	c.sessionToken = token
+	c.Room = room
+	room.Members.Set(c, true)
+	room.Members.Delete(old)
+	old.Room = nil
+
+	snapshot, operations, err := getOperations(room.RoomName, sinceSeq, sinceBucket, c.HasCapability(CapSnapshots))
+	if err != nil || snapshot != nil {
+		// Too far behind to replay, so end the session as if it expired
+		log.Warnf("unable to replay operations to resume session for user \"%s\": %v", userID, err)
+		c.leaveRoom()
+		c.sessionToken = ""
+		return nil, false
+	}
+	sessions.Set(token, c)
+	log.Infof("resumed session for user \"%s\" in room %s, replaying %d operations", userID, room.RoomName, len(operations))
+	return operations, true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// commitDuringReadStore commits and broadcasts an operation the first time operations are read, like a member
+// submitting one while a session is resumed.
+type commitDuringReadStore struct {
+	*MemoryStore
+	room      *Room
+	committed bool
+}
+
+func (s *commitDuringReadStore) GetOperationsSince(roomName string, sinceSeq int64, sinceBucket int) ([]bson.M, error) {
+	if !s.committed {
+		s.committed = true
+		_, fresh, err := s.MemoryStore.CommitOperations(roomName, []bson.M{{"type": "ADD_STEP"}})
+		if err != nil {
+			return nil, err
+		}
+		ops, err := s.MemoryStore.GetOperationsSince(roomName, sinceSeq, sinceBucket)
+		s.room.Broadcast(NewOperationsUpdateMessage(fresh, 0))
+		return ops[:len(ops)-1], err
+	}
+	return s.MemoryStore.GetOperationsSince(roomName, sinceSeq, sinceBucket)
+}
+
+func TestResumeSession(t *testing.T) {
+	old := newTestRoom(t, "room", "user", bson.M{})
+	commitTestOperations(t, "room", bson.M{"type": "ADD_STEP"}, bson.M{"type": "ADD_STEP"})
+	old.sessionToken = "token"
+	old.detached = 1
+	sessions = NewSessionMap()
+	sessions.Set("token", old)
+	room := old.Room
+	database = &commitDuringReadStore{MemoryStore: database.(*MemoryStore), room: room}
+
+	c := newTestClient("user")
+	c.SetCapabilities([]string{CapFetchOperations})
+	operations, ok := resumeSession(c, "token", "user", 1, 1)
+	if !ok {
+		t.Fatal("unable to resume session")
+	}
+	if len(operations) != 1 || opSeq(operations[0]) != 2 {
+		t.Errorf("got replay %v, want seq 2", operations)
+	}
+	if c.Room != room || old.Room != nil {
+		t.Errorf("room membership didn't move to the new client")
+	}
+	if _, ok := room.Members.Get(c); !ok {
+		t.Errorf("new client isn't a member of the room")
+	}
+	if _, ok := room.Members.Get(old); ok {
+		t.Errorf("old client is still a member of the room")
+	}
+
+	// The operation committed while reading wasn't replayed, so it must have been broadcast to the new client
+	if len(c.send.queue) != 1 {
+		t.Errorf("got %d messages queued for the new client, want the broadcast operation", len(c.send.queue))
+	}
+
+	// The session can't be resumed twice
+	if _, ok := resumeSession(newTestClient("user"), "token", "user", 1, 1); ok {
+		t.Errorf("resumed a session that is connected")
+	}
+}
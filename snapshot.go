@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// StateKeyOperations is the key in a full state holding the operations folded into it.
+const StateKeyOperations = "operations"
+
+// SnapshotDoc is a document that stores the materialized state of a room up to a bucket watermark.
+type SnapshotDoc struct {
+	ID        primitive.ObjectID `bson:"_id" json:"-"`
+	RoomName  string             `bson:"room_name" json:"roomName"`
+	Bucket    int                `bson:"bucket" json:"bucket"`
+	LastSeq   int64              `bson:"last_seq" json:"lastSeq"`
+	CreatedAt int64              `bson:"created_at" json:"createdAt"`
+	State     bson.M             `bson:"state" json:"state"`
+
+	// Stores that split the state's operations across SnapshotChunkDocs set the version of the chunks and how many
+	// there are.
+	Version primitive.ObjectID `bson:"version,omitempty" json:"-"`
+	Chunks  int                `bson:"chunks,omitempty" json:"-"`
+}
+
+// SnapshotChunkDoc is a document that stores part of the operations folded into a snapshot.
+type SnapshotChunkDoc struct {
+	ID       primitive.ObjectID `bson:"_id"`
+	RoomName string             `bson:"room_name"`
+	Version  primitive.ObjectID `bson:"version"`
+	Index    int                `bson:"index"`
+	Ops      []bson.M           `bson:"operations"`
+}
+
+// Folder folds operations onto a full state (in the same shape as TypeState messages), returning the new state.
+type Folder func(state bson.M, ops []bson.M) bson.M
+
+// folders fold the operations of rooms by room type. Rooms of other types aren't snapshotted, as their snapshot would
+// only be a copy of the operation log.
+var folders = make(map[string]Folder)
+
+// ErrNoFolder is returned when snapshotting a room of a type without a registered Folder.
+var ErrNoFolder = errors.New("no folder registered for room type")
+
+// RegisterFolder registers how the operations of rooms of roomType are folded into their snapshots.
+func RegisterFolder(roomType string, folder Folder) {
+	folders[roomType] = folder
+}
+
+// folderFor returns the Folder for rooms of roomType, and whether one is registered.
+func folderFor(roomType string) (Folder, bool) {
+	folder, ok := folders[roomType]
+	return folder, ok
+}
+
+// roomTypeOf returns the type of a room from its metadata, or "" if it can't be loaded.
+func roomTypeOf(roomName string) string {
+	if room, ok := rooms.Get(roomName); ok {
+		return room.Metadata().Type
+	}
+	if roomSource == nil {
+		return ""
+	}
+	doc, err := roomSource.GetRoom(roomName)
+	if err != nil {
+		log.Warnf("unable to get type of room %s: %s", roomName, err)
+		return ""
+	}
+	roomType, _ := doc["type"].(string)
+	return roomType
+}
+
+// appendOperations folds operations by appending them to the state's operations, which is lossless for any room type.
+// Folders use it for the operations they can't reduce.
+func appendOperations(state bson.M, ops []bson.M) bson.M {
+	folded := bson.M{}
+	for k, v := range state {
+		folded[k] = v
+	}
+	existing := asOperations(state[StateKeyOperations])
+	all := make([]bson.M, 0, len(existing)+len(ops))
+	all = append(all, existing...)
+	all = append(all, ops...)
+	folded[StateKeyOperations] = all
+	return folded
+}
+
+// splitSnapshotOperations splits operations into chunks of up to maxBytes when stored, an operation larger than maxBytes is
+// chunked on its own.
+func splitSnapshotOperations(ops []bson.M, maxBytes int) [][]bson.M {
+	chunks := [][]bson.M{}
+	bytes := 0
+	for _, op := range ops {
+		size := opSize(op)
+		if len(chunks) == 0 || bytes+size > maxBytes {
+			chunks = append(chunks, []bson.M{})
+			bytes = 0
+		}
+		chunks[len(chunks)-1] = append(chunks[len(chunks)-1], op)
+		bytes += size
+	}
+	return chunks
+}
+
+// asOperations converts a decoded operations array into []bson.M, skipping anything that isn't a document.
+func asOperations(v interface{}) []bson.M {
+	switch ops := v.(type) {
+	case []bson.M:
+		return ops
+	case primitive.A:
+		return asOperations([]interface{}(ops))
+	case []interface{}:
+		converted := make([]bson.M, 0, len(ops))
+		for _, op := range ops {
+			switch doc := op.(type) {
+			case bson.M:
+				converted = append(converted, doc)
+			case primitive.D:
+				converted = append(converted, doc.Map())
+			case map[string]interface{}:
+				converted = append(converted, bson.M(doc))
+			}
+		}
+		return converted
+	}
+	return []bson.M{}
+}
+
+// SnapshotRoom folds all full operation buckets of a room into its snapshot,
+// archiving the folded buckets if archive is set.
+// The room is locked throughout, so a rebalance can't renumber the buckets between reading and archiving them.
+// Fails with ErrNoFolder if the room's type has no registered Folder.
+func SnapshotRoom(roomName string, archive bool) (*SnapshotDoc, error) {
+	roomType := roomTypeOf(roomName)
+	folder, ok := folderFor(roomType)
+	if !ok {
+		return nil, fmt.Errorf("%w \"%s\" of room %s", ErrNoFolder, roomType, roomName)
+	}
+
+	unlock := database.LockRoom(roomName)
+	defer unlock()
+
+	room, err := database.GetRoom(roomName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get room: %w", err)
+	}
+	snapshot, err := database.GetSnapshot(roomName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get snapshot: %w", err)
+	}
+	if snapshot == nil {
+		snapshot = &SnapshotDoc{
+			ID:       primitive.NewObjectID(),
+			RoomName: roomName,
+			State:    bson.M{},
+		}
+	}
+
+	// The current bucket is still being written to, so only fold the buckets before it
+	watermark := room.NumBuckets - 1
+	if watermark <= snapshot.Bucket {
+		return snapshot, nil
+	}
+	buckets, err := database.GetOperationBuckets(roomName, snapshot.Bucket+1, watermark)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get operation buckets: %w", err)
+	}
+
+	ops := []bson.M{}
+	for _, bucketDoc := range buckets {
+		ops = append(ops, bucketDoc.Ops...)
+		for _, op := range bucketDoc.Ops {
+			if seq := opSeq(op); seq > snapshot.LastSeq {
+				snapshot.LastSeq = seq
+			}
+		}
+	}
+	snapshot.State = folder(snapshot.State, ops)
+	snapshot.Bucket = watermark
+	snapshot.CreatedAt = nowMillis()
+
+	err = database.SaveSnapshot(snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("unable to save snapshot: %w", err)
+	}
+	log.Infof("snapshotted room %s through bucket %d (seq %d)", roomName, snapshot.Bucket, snapshot.LastSeq)
+
+	if archive {
+		err = database.ArchiveOperations(roomName, watermark)
+		if err != nil {
+			return nil, fmt.Errorf("unable to archive operations: %w", err)
+		}
+	}
+	return snapshot, nil
+}
+
+// StartSnapshotter periodically snapshots all rooms the server is tracking,
+// configured by SNAPSHOT_INTERVAL (seconds, disabled if unset) and SNAPSHOT_ARCHIVE.
+func StartSnapshotter() {
+	intervalEnv := os.Getenv("SNAPSHOT_INTERVAL")
+	if intervalEnv == "" {
+		return
+	}
+	interval, err := strconv.Atoi(intervalEnv)
+	if err != nil || interval <= 0 {
+		log.Fatalf("unable to parse SNAPSHOT_INTERVAL \"%s\" as a positive number of seconds", intervalEnv)
+	}
+	archive := os.Getenv("SNAPSHOT_ARCHIVE") == "1"
+
+	log.Infof("snapshotting rooms every %d seconds (archive: %t)", interval, archive)
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		for range ticker.C {
+			roomNames := []string{}
+			rooms.Range(func(roomName string, _ *Room) bool {
+				roomNames = append(roomNames, roomName)
+				return true
+			})
+			for _, roomName := range roomNames {
+				_, err := SnapshotRoom(roomName, archive)
+				if errors.Is(err, ErrNoFolder) {
+					continue
+				}
+				if err != nil {
+					log.Errorf("unable to snapshot room %s: %s", roomName, err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// newSnapshotTestStore sets up a MemoryStore with small buckets, serving a room of roomType.
+func newSnapshotTestStore(roomName string, roomType string, maxOps int) *MemoryStore {
+	store := NewMemoryStore()
+	store.maxOpsPerBucket = maxOps
+	database = store
+	roomSource = &FileRoomSource{rooms: map[string]bson.M{roomName: {"type": roomType}}}
+	rooms = NewRoomMap()
+	return store
+}
+
+// commitTestOperations commits operations to a room one at a time.
+func commitTestOperations(t *testing.T, roomName string, ops ...bson.M) {
+	t.Helper()
+	for _, op := range ops {
+		_, _, err := database.CommitOperations(roomName, []bson.M{op})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSnapshotRoomArchive(t *testing.T) {
+	store := newSnapshotTestStore("room", RoomTypePianoRollSequencer, 2)
+	for i := 0; i < 5; i++ {
+		commitTestOperations(t, "room", bson.M{"type": "ADD_STEP", "n": i})
+	}
+
+	// Buckets 1 and 2 are full, bucket 3 holds the fifth operation and is still being written to
+	snapshot, err := SnapshotRoom("room", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Bucket != 2 || snapshot.LastSeq != 4 {
+		t.Errorf("got snapshot through bucket %d (seq %d), want bucket 2 (seq 4)", snapshot.Bucket, snapshot.LastSeq)
+	}
+	if ops := asOperations(snapshot.State[StateKeyOperations]); len(ops) != 4 {
+		t.Errorf("got %d folded operations, want 4", len(ops))
+	}
+
+	live, _ := store.GetOperationBuckets("room", 1, 10)
+	archived, _ := store.GetArchivedOperationBuckets("room", 1, 10)
+	if len(live) != 1 || live[0].Bucket != 3 {
+		t.Errorf("got %d live buckets, want only bucket 3", len(live))
+	}
+	if len(archived) != 2 {
+		t.Errorf("got %d archived buckets, want 2", len(archived))
+	}
+
+	// Snapshotting again without new full buckets changes nothing
+	again, err := SnapshotRoom("room", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Bucket != 2 || again.LastSeq != 4 {
+		t.Errorf("got snapshot through bucket %d (seq %d), want it unchanged", again.Bucket, again.LastSeq)
+	}
+
+	// Later snapshots fold onto the saved one
+	commitTestOperations(t, "room", bson.M{"type": "ADD_STEP", "n": 5}, bson.M{"type": "ADD_STEP", "n": 6})
+	snapshot, err = SnapshotRoom("room", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := asOperations(snapshot.State[StateKeyOperations])
+	if snapshot.Bucket != 3 || len(ops) != 6 {
+		t.Fatalf("got snapshot through bucket %d of %d operations, want bucket 3 of 6", snapshot.Bucket, len(ops))
+	}
+	for i, op := range ops {
+		if opSeq(op) != int64(i+1) {
+			t.Errorf("folded operation %d has seq %d, want %d", i, opSeq(op), i+1)
+		}
+	}
+
+	tail, err := store.GetOperationsSince("room", -1, snapshot.Bucket+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tail) != 1 || opSeq(tail[0]) != 7 {
+		t.Errorf("got tail %v, want seq 7", tail)
+	}
+}
+
+func TestSnapshotRoomWithoutFolder(t *testing.T) {
+	store := newSnapshotTestStore("room", "", 1)
+	commitTestOperations(t, "room", bson.M{"type": "ADD_STEP"}, bson.M{"type": "ADD_STEP"})
+
+	// The snapshot would only copy the log, so the room is left as is
+	_, err := SnapshotRoom("room", true)
+	if !errors.Is(err, ErrNoFolder) {
+		t.Errorf("got error %v, want ErrNoFolder", err)
+	}
+	if snapshot, _ := store.GetSnapshot("room"); snapshot != nil {
+		t.Errorf("got snapshot %v, want none", snapshot)
+	}
+	if live, _ := store.GetOperationBuckets("room", 1, 10); len(live) != 2 {
+		t.Errorf("got %d live buckets, want 2", len(live))
+	}
+}
+
+func TestFoldPianoRollSequencer(t *testing.T) {
+	newSnapshotTestStore("sequencer", RoomTypePianoRollSequencer, 100)
+	fold, ok := folderFor(roomTypeOf("sequencer"))
+	if !ok {
+		t.Fatal("no folder registered for the sequencer")
+	}
+	volume := func(track int, value float64) bson.M {
+		return bson.M{"type": "UPDATE_TRACK_VOLUME", "contentId": 0, "payload": bson.M{"track": track, "value": value}}
+	}
+	parameter := func(id string, value float64) bson.M {
+		return bson.M{"type": "UPDATE_PARAMETER", "contentId": id, "payload": bson.M{"parameter": id, "value": value}}
+	}
+	step := func(n int) bson.M {
+		return bson.M{"type": "ADD_STEP", "contentId": "step", "payload": bson.M{"stepNumber": n}}
+	}
+
+	tests := []struct {
+		name   string
+		state  bson.M
+		ops    []bson.M
+		values []interface{} // payload.value or payload.stepNumber of the folded operations
+	}{
+		{"nothing to fold", bson.M{}, []bson.M{}, []interface{}{}},
+		{"steps are kept", bson.M{}, []bson.M{step(1), step(1), step(2)}, []interface{}{1, 1, 2}},
+		{"last set wins", bson.M{}, []bson.M{parameter("cutoff", 1), step(1), parameter("cutoff", 2)}, []interface{}{1, 2.0}},
+		{"sets of other content are kept", bson.M{}, []bson.M{parameter("cutoff", 1), parameter("resonance", 2)}, []interface{}{1.0, 2.0}},
+		{"sets of other tracks are kept", bson.M{}, []bson.M{volume(1, 0.5), volume(2, 0.7), volume(1, 0.9)}, []interface{}{0.7, 0.9}},
+		{"sets supersede the state", bson.M{StateKeyOperations: []bson.M{parameter("cutoff", 1), step(3)}}, []bson.M{parameter("cutoff", 4)}, []interface{}{3, 4.0}},
+		{"sets without content are kept", bson.M{}, []bson.M{{"type": "UPDATE_PARAMETER", "payload": bson.M{"value": 1}}, {"type": "UPDATE_PARAMETER", "payload": bson.M{"value": 2}}}, []interface{}{1, 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			folded := fold(test.state, test.ops)
+			ops := asOperations(folded[StateKeyOperations])
+			if len(ops) != len(test.values) {
+				t.Fatalf("got %d folded operations, want %d", len(ops), len(test.values))
+			}
+			for i, op := range ops {
+				payload, _ := asMap(op["payload"])
+				value, ok := payload["value"]
+				if !ok {
+					value = payload["stepNumber"]
+				}
+				if fmt.Sprint(value) != fmt.Sprint(test.values[i]) {
+					t.Errorf("folded operation %d has value %v, want %v", i, value, test.values[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSplitSnapshotOperations(t *testing.T) {
+	op := bson.M{"type": "ADD_STEP", "payload": bson.M{"stepNumber": 1}}
+	size := opSize(op)
+
+	tests := []struct {
+		name     string
+		n        int
+		maxBytes int
+		chunks   []int
+	}{
+		{"none", 0, size, []int{}},
+		{"one chunk", 3, 3 * size, []int{3}},
+		{"split", 5, 2 * size, []int{2, 2, 1}},
+		{"larger than a chunk", 2, size / 2, []int{1, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ops := []bson.M{}
+			for i := 0; i < test.n; i++ {
+				ops = append(ops, op)
+			}
+			chunks := splitSnapshotOperations(ops, test.maxBytes)
+			if len(chunks) != len(test.chunks) {
+				t.Fatalf("got %d chunks, want %d", len(chunks), len(test.chunks))
+			}
+			for i, chunk := range chunks {
+				if len(chunk) != test.chunks[i] {
+					t.Errorf("chunk %d has %d operations, want %d", i, len(chunk), test.chunks[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSnapshotRoomLocksRoom(t *testing.T) {
+	newSnapshotTestStore("room", RoomTypePianoRollSequencer, 1)
+	commitTestOperations(t, "room", bson.M{"type": "ADD_STEP"}, bson.M{"type": "ADD_STEP"})
+
+	// A rebalance holding the room must finish before the snapshot reads the buckets
+	unlock := database.LockRoom("room")
+	done := make(chan *SnapshotDoc)
+	go func() {
+		snapshot, err := SnapshotRoom("room", true)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- snapshot
+	}()
+	select {
+	case <-done:
+		t.Fatal("snapshot ran while the room was locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	if snapshot := <-done; snapshot == nil || snapshot.LastSeq != 2 {
+		t.Errorf("got snapshot %v, want one through seq 2", snapshot)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Storage backends, selected with the STORE env var
+const (
+	StoreMongo  = "mongo"
+	StoreMemory = "memory"
+)
+
+// Keys the server stamps onto every committed operation
+const (
+	OpKeySeq        = "seq"        // Per-room, gap-free sequence number starting at 1
+	OpKeyBucket     = "bucket"     // Bucket the operation was written to
+	OpKeyCommitTime = "commitTime" // Server commit time in milliseconds since the epoch
+)
+
+// ErrRoomNotFound is returned by stores when a room doesn't exist and can't be created.
+var ErrRoomNotFound = errors.New("room not found")
+
+// database is the common reference to the room and operation store
+var database Store
+
+// Store persists rooms and the operations committed in them.
+type Store interface {
+	// GetRoom gets the room document given a human-readable roomName, creating it if it doesn't exist.
+	GetRoom(roomName string) (*RoomDoc, error)
+
+	// UpdateRoomNumMembers increments/decrements the number of members in a room.
+	UpdateRoomNumMembers(roomName string, updateIncrement int) (*RoomDoc, error)
+
+	// CommitOperations writes operations committed in a room, stamping each with its sequence number.
+	// Operations whose ID was already committed to the room within the dedupe window are not written again.
+	// Returns the operations in submission order, with the originally committed operation in place of those,
+	// 	and the operations that were newly committed.
+	CommitOperations(roomName string, ops []bson.M) ([]bson.M, []bson.M, error)
+
+	// GetCommittedOperations returns the operations with the given IDs committed in a room within the dedupe window,
+	// 	by ID.
+	GetCommittedOperations(roomName string, ids []string) (map[string]bson.M, error)
+
+	// GetAllOperations returns the full history of operations for a given room.
+	GetAllOperations(roomName string) ([]bson.M, error)
+
+	// GetOperationsSince returns the operations for a given room with a sequence number greater than sinceSeq,
+	// 	searching from sinceBucket onwards.
+	GetOperationsSince(roomName string, sinceSeq int64, sinceBucket int) ([]bson.M, error)
+
+	// GetOperationBuckets returns the operation buckets for a given room from fromBucket to toBucket inclusive, in bucket order.
+	GetOperationBuckets(roomName string, fromBucket int, toBucket int) ([]OpBucketDoc, error)
+
+	// GetArchivedOperationBuckets returns the archived operation buckets for a given room from fromBucket to toBucket
+	// 	inclusive, in bucket order.
+	GetArchivedOperationBuckets(roomName string, fromBucket int, toBucket int) ([]OpBucketDoc, error)
+
+	// GetSnapshot returns the latest snapshot for a given room, or nil if there is none.
+	GetSnapshot(roomName string) (*SnapshotDoc, error)
+
+	// SaveSnapshot replaces the snapshot for the snapshot's room.
+	SaveSnapshot(snapshot *SnapshotDoc) error
+
+	// ArchiveOperations moves the operation buckets for a given room up to throughBucket inclusive into the archive.
+	// 	The room must be locked with LockRoom.
+	ArchiveOperations(roomName string, throughBucket int) error
+
+	// RebalanceOperations splits a room's buckets that are over the count or byte limits, renumbering the buckets
+	// 	after them and the room's snapshot watermark.
+	RebalanceOperations(roomName string) (*RebalanceResult, error)
+
+	// LockRoom locks a room against commits, rebalances and other holders of the lock on this server, returning the
+	// 	function to unlock it. Work that reads a room's buckets and writes back bucket numbers holds it throughout.
+	LockRoom(roomName string) func()
+
+	// ImportRoom creates a room with the given operation buckets, failing if the room already exists.
+	ImportRoom(room *RoomDoc, buckets []OpBucketDoc) error
+
+	// DeleteAllOperations deletes all operations, archived operations, snapshots and operation IDs for a given room.
+	DeleteAllOperations(roomName string) error
+
+	// ResetNumMembers sets the numMembers to 0 for all rooms.
+	ResetNumMembers() error
+}
+
+// NewStore creates the store selected by the STORE env var, defaulting to mongo.
+func NewStore() Store {
+	backend := os.Getenv("STORE")
+	switch backend {
+	case "", StoreMongo:
+		mongoConnectString := os.Getenv("MONGO_CONNECTION_URL")
+		return NewDB(mongoConnectString)
+	case StoreMemory:
+		log.Infof("using in-memory store, data will not persist across restarts")
+		return NewMemoryStore()
+	default:
+		log.Fatalf("unknown STORE \"%s\"", backend)
+	}
+	return nil
+}
+
+// stampOperation sets the server-assigned fields on an operation.
+func stampOperation(op bson.M, seq int64, bucket int, commitTime int64) {
+	op[OpKeySeq] = seq
+	op[OpKeyBucket] = bucket
+	op[OpKeyCommitTime] = commitTime
+}
+
+// opSeq returns the sequence number of a committed operation, or 0 if it predates sequence numbers.
+func opSeq(op bson.M) int64 {
+	return opInt(op, OpKeySeq)
+}
+
+// opCommitTime returns the server commit time of an operation, or 0 if it predates commit times.
+func opCommitTime(op bson.M) int64 {
+	return opInt(op, OpKeyCommitTime)
+}
+
+// opInt returns a numeric field of an operation regardless of how it was decoded, or 0 if it isn't set.
+func opInt(op bson.M, key string) int64 {
+	switch v := op[key].(type) {
+	case int64:
+		return v
+	case int32:
+		return int64(v)
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	case float32:
+		return int64(v)
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+// filterOperationsSince returns the operations with a sequence number greater than sinceSeq.
+func filterOperationsSince(ops []bson.M, sinceSeq int64) []bson.M {
+	filtered := []bson.M{}
+	for _, op := range ops {
+		if opSeq(op) > sinceSeq {
+			filtered = append(filtered, op)
+		}
+	}
+	return filtered
+}
+
+// nowMillis returns the current time in milliseconds since the epoch, like Date.now().
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
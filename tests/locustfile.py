@@ -50,10 +50,12 @@ class CommitOperationTaskSet(TaskSet):
         self.id = str(uuid.uuid4())
         self.ws = create_connection(f"ws://{HOSTNAME}/ws")
 
-        # Announce user
+        # Announce user, the server must run with ENV=local to take the user ID as the ID token
         announce_msg = json.dumps({
             "type": "announce",
-            "userID": self.id
+            "protocolVersion": 3,
+            "userID": self.id,
+            "idToken": self.id
         })
         self.ws.send(announce_msg)
 
@@ -52,6 +52,13 @@ func (c *ClientMap) Range(f func(k *Client, v bool) bool) {
 	c.RUnlock()
 }
 
+// Len returns the number of clients in the map.
+func (c *ClientMap) Len() int {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.m)
+}
+
 // GetRandomClient returns a random client from the map.
 func (c *ClientMap) GetRandomClient() *Client {
 	c.Lock()
@@ -71,6 +78,22 @@ func (c *ClientMap) GetRandomClient() *Client {
 	return nil
 }
 
+// GetRandomClientWith returns a random client from the map for which f returns true, or nil if there is none.
+func (c *ClientMap) GetRandomClientWith(f func(*Client) bool) *Client {
+	c.Lock()
+	defer c.Unlock()
+	candidates := []*Client{}
+	for client := range c.m {
+		if f(client) {
+			candidates = append(candidates, client)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
 // RoomMap is a concurrency-safe map of room names to rooms.
 type RoomMap struct {
 	sync.RWMutex
@@ -105,3 +128,57 @@ func (r *RoomMap) Delete(k string) {
 	delete(r.m, k)
 	r.Unlock()
 }
+
+// Range iterates over the map.
+func (r *RoomMap) Range(f func(k string, v *Room) bool) {
+	r.RLock()
+	for k, v := range r.m {
+		ok := f(k, v)
+		if !ok {
+			break
+		}
+	}
+	r.RUnlock()
+}
+
+// KeyedMutex is a set of mutexes by key, so holders of different keys don't block each other.
+type KeyedMutex struct {
+	sync.Mutex
+	m map[string]*keyedLock
+}
+
+// keyedLock is the mutex for a key, counting holders and waiters so it can be freed when unused.
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+// NewKeyedMutex instantiates a KeyedMutex.
+func NewKeyedMutex() *KeyedMutex {
+	return &KeyedMutex{
+		m: make(map[string]*keyedLock),
+	}
+}
+
+// Lock locks the mutex for a key, returning the function to unlock it.
+func (k *KeyedMutex) Lock(key string) func() {
+	k.Mutex.Lock()
+	l, ok := k.m[key]
+	if !ok {
+		l = &keyedLock{}
+		k.m[key] = l
+	}
+	l.refs++
+	k.Mutex.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.Mutex.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.m, key)
+		}
+		k.Mutex.Unlock()
+	}
+}
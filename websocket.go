@@ -0,0 +1,138 @@
+package main
+
+import (
+	"compress/flate"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Websocket defaults, overridden with the WS_* env vars
+const (
+	DefaultBufferSize      = 4096
+	DefaultMaxMessageSize  = 1 << 20 // 1 MiB
+	DefaultChunkOperations = 1000
+	DefaultPongWait        = 60 * time.Second
+	DefaultWriteWait       = 10 * time.Second
+)
+
+var (
+	// Whether permessage-deflate is used when the client offers it.
+	enableCompression = false
+
+	// Compression level for outbound messages, see compress/flate.
+	compressionLevel = flate.BestSpeed
+
+	// Largest inbound message in bytes, larger messages close the connection with CloseMessageTooBig.
+	maxMessageSize int64 = DefaultMaxMessageSize
+
+	// Most operations sent in a single enterRoom message to clients that accept chunks.
+	chunkOperations = DefaultChunkOperations
+
+	// How long to wait for a pong before the connection is reaped, pings are sent at 9/10 of this.
+	pongWait = DefaultPongWait
+
+	// How long to wait for a message to be written before the connection is reaped.
+	writeWait = DefaultWriteWait
+
+	// How long a client may go without sending a message before the connection is reaped, 0 disables.
+	idleTimeout time.Duration
+)
+
+// loadWebsocket configures the upgrader and connection limits from the WS_* env vars.
+func loadWebsocket() {
+	upgrader.ReadBufferSize = envInt("WS_READ_BUFFER_SIZE", DefaultBufferSize, 1)
+	upgrader.WriteBufferSize = envInt("WS_WRITE_BUFFER_SIZE", DefaultBufferSize, 1)
+
+	enableCompression = os.Getenv("WS_COMPRESSION") == "1"
+	upgrader.EnableCompression = enableCompression
+	compressionLevel = envInt("WS_COMPRESSION_LEVEL", flate.BestSpeed, flate.HuffmanOnly)
+	if compressionLevel > flate.BestCompression {
+		log.Fatalf("WS_COMPRESSION_LEVEL must be between %d and %d", flate.HuffmanOnly, flate.BestCompression)
+	}
+
+	maxMessageSize = int64(envInt("WS_MAX_MESSAGE_SIZE", DefaultMaxMessageSize, 1))
+	chunkOperations = envInt("WS_CHUNK_OPERATIONS", DefaultChunkOperations, 1)
+
+	pongWait = envMillis("WS_PONG_WAIT", DefaultPongWait, 1)
+	writeWait = envMillis("WS_WRITE_WAIT", DefaultWriteWait, 1)
+	idleTimeout = envMillis("WS_IDLE_TIMEOUT", 0, 0)
+
+	log.Infof("websocket pong wait %s, write wait %s, idle timeout %s", pongWait, writeWait, idleTimeout)
+	log.Infof("websocket buffers %d/%d bytes, compression %t (level %d), max message size %d bytes, %d operations per chunk",
+		upgrader.ReadBufferSize, upgrader.WriteBufferSize, enableCompression, compressionLevel, maxMessageSize, chunkOperations)
+}
+
+// envInt parses an integer env var no less than min, returning def if it isn't set.
+func envInt(key string, def int, min int) int {
+	env := os.Getenv(key)
+	if env == "" {
+		return def
+	}
+	v, err := strconv.Atoi(env)
+	if err != nil || v < min {
+		log.Fatalf("unable to parse %s \"%s\" as an integer no less than %d", key, env, min)
+	}
+	return v
+}
+
+// envMillis parses a duration of at least min milliseconds from an env var, returning def if it isn't set.
+func envMillis(key string, def time.Duration, min int) time.Duration {
+	millis := envInt(key, int(def/time.Millisecond), min)
+	return time.Duration(millis) * time.Millisecond
+}
+
+// pingPeriod is how often to ping a client, leaving time for the pong to arrive before the read deadline.
+func pingPeriod() time.Duration {
+	return pongWait * 9 / 10
+}
+
+// configureConn applies the connection limits, read deadline and compression settings to a new connection.
+func configureConn(conn *websocket.Conn) {
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	conn.EnableWriteCompression(enableCompression)
+	if enableCompression {
+		err := conn.SetCompressionLevel(compressionLevel)
+		if err != nil {
+			log.Errorf("unable to set compression level: %s", err)
+		}
+	}
+}
+
+// sendEnterRoomResponse sends an enterRoom response, splitting its operations into an operationsChunk message per
+// chunkOperations if the client accepts chunks.
+func sendEnterRoomResponse(c *Client, res *EnterRoomResponse) {
+	ops := res.Operations
+	if !c.HasCapability(CapChunkedOperations) || len(ops) <= chunkOperations {
+		c.Send(res)
+		return
+	}
+
+	chunks := (len(ops) + chunkOperations - 1) / chunkOperations
+	res.Operations = ops[:chunkOperations]
+	res.Chunks = chunks
+	err := c.Send(res)
+	if err != nil {
+		log.Errorf("unable to send enterRoom response: %s", err)
+		return
+	}
+	for chunk := 1; chunk < chunks; chunk++ {
+		start := chunk * chunkOperations
+		end := start + chunkOperations
+		if end > len(ops) {
+			end = len(ops)
+		}
+		err := c.Send(NewOperationsChunkMessage(res.ID, chunk, chunks, ops[start:end]))
+		if err != nil {
+			log.Errorf("unable to send operations chunk %d of %d: %s", chunk+1, chunks, err)
+			return
+		}
+	}
+}
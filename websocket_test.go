@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestSendEnterRoomResponse(t *testing.T) {
+	defer func(n int) { chunkOperations = n }(chunkOperations)
+	chunkOperations = 2
+	ops := []bson.M{{"n": 0}, {"n": 1}, {"n": 2}, {"n": 3}, {"n": 4}}
+
+	// Clients that don't accept chunks get every operation in the response
+	c := newTestClient("legacy")
+	sendEnterRoomResponse(c, &EnterRoomResponse{Response: Response{ID: "1"}, Operations: ops})
+	if res := nextMessage(c).(*EnterRoomResponse); len(res.Operations) != 5 || res.Chunks != 0 {
+		t.Errorf("got %d operations in %d chunks, want 5 unchunked", len(res.Operations), res.Chunks)
+	}
+
+	c = newTestClient("chunked")
+	c.SetCapabilities([]string{CapChunkedOperations})
+	sendEnterRoomResponse(c, &EnterRoomResponse{Response: Response{ID: "2"}, Operations: ops})
+	res := nextMessage(c).(*EnterRoomResponse)
+	if len(res.Operations) != 2 || res.Chunks != 3 {
+		t.Fatalf("got %d operations in %d chunks, want 2 in 3", len(res.Operations), res.Chunks)
+	}
+	n := len(res.Operations)
+	for chunk := 1; chunk < 3; chunk++ {
+		m := nextMessage(c).(*OperationsChunkMessage)
+		if m.ID != "2" || m.Type != TypeOperationsChunk || m.Chunk != chunk || m.Chunks != 3 {
+			t.Errorf("got chunk %+v, want chunk %d of 3", m, chunk)
+		}
+		for _, op := range m.Operations {
+			if op["n"] != n {
+				t.Errorf("got operation %v, want n %d", op, n)
+			}
+			n++
+		}
+	}
+	if n != 5 || queuedMessages(c) != 0 {
+		t.Errorf("got %d operations and %d extra messages, want 5 and none", n, queuedMessages(c))
+	}
+}
+
+func TestIdleConnectionReaped(t *testing.T) {
+	defer func(timeout time.Duration) { idleTimeout = timeout }(idleTimeout)
+	idleTimeout = 50 * time.Millisecond
+	reaped := atomic.LoadInt64(&metrics.reapedIdleTimeout)
+
+	server := httptest.NewServer(http.HandlerFunc(wsHandler))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A client that never sends a message is closed once it has been idle for the timeout
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("got %v, want the connection closed as idle", err)
+	}
+	for atomic.LoadInt64(&metrics.reapedIdleTimeout) == reaped {
+		time.Sleep(time.Millisecond)
+	}
+}